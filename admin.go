@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+)
+
+// Only one reindex may build a new index version at a time
+var reindexInProgress atomic.Bool
+
+func startReindex(c *gin.Context, pgDB *sql.DB, esClient *elasticsearch.Client) {
+	// Only the elasticsearch sink has an index to rebuild
+	projectsIndex.Lock()
+	_, ok := projectsIndex.sinks[0].(*elasticsearchSink)
+	projectsIndex.Unlock()
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reindex requires the elasticsearch sink"})
+		return
+	}
+
+	if !reindexInProgress.CompareAndSwap(false, true) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A reindex is already running"})
+		return
+	}
+
+	// Reindexing takes a while, the alias is swapped once the new index is complete
+	go func() {
+		defer reindexInProgress.Store(false)
+
+		err := reindexProjects(pgDB, esClient)
+		if err != nil {
+			log.Printf("Error reindexing projects: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Reindex started"})
+}
+
+func listDeadLettersHandler(c *gin.Context, pgDB *sql.DB) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(deadLettersPageSize)))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	deadLetters, err := listDeadLetters(pgDB, limit, offset)
+	if err != nil {
+		log.Printf("Error listing dead letters: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list dead letters"})
+		return
+	}
+	c.JSON(http.StatusOK, deadLetters)
+}
+
+func getDeadLetterHandler(c *gin.Context, pgDB *sql.DB) {
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	letter, err := getDeadLetter(pgDB, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching dead letter %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dead letter"})
+		return
+	}
+	c.JSON(http.StatusOK, letter)
+}
+
+func retryDeadLetterHandler(c *gin.Context, handler *syncHandler) {
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	err := handler.retryDeadLetter(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Retry failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter synced"})
+}
+
+func retryAllDeadLettersHandler(c *gin.Context, handler *syncHandler) {
+	synced, failed, err := handler.retryAllDeadLetters()
+	if err != nil {
+		log.Printf("Error retrying dead letters: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry dead letters"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"synced": synced, "failed": failed})
+}
+
+func discardDeadLetterHandler(c *gin.Context, pgDB *sql.DB) {
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	err := discardDeadLetter(pgDB, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error discarding dead letter %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to discard dead letter"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter discarded"})
+}
+
+// Function to read the dead letter id from the path, responds with 400 if it is invalid
+func deadLetterID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dead letter id"})
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// Number of projects read from postgres and written to the sink per page
+const backfillPageSize = 500
+
+// Function to write every project in postgres to the sink before live sync starts.
+//
+// The backfill reads from a single repeatable read snapshot. Pending outbox events are left
+// for live sync, the snapshot only writes projects that still exist, so deletes recorded while
+// the service was down are only applied by their events. Applying an event the snapshot already
+// covers rebuilds the project once more from current state, and the versions keep the snapshot
+// from replacing newer documents, so the handoff has no gaps.
+// The replication slot keeps its position as well, replayed changes are just as harmless
+func backfillProjects(pgDB *sql.DB, sink Sink) error {
+	indexed, err := indexProjectsSnapshot(context.Background(), pgDB, sink)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Backfill indexed %d projects.", indexed)
+	return nil
+}
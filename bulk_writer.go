@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// Limits at which buffered writes are sent to elasticsearch, whichever is reached first
+type bulkWriterConfig struct {
+	MaxItems      int
+	MaxBytes      int
+	FlushInterval time.Duration
+	// Refresh policy of the bulk requests, false, wait_for or true
+	Refresh string
+}
+
+var defaultBulkWriterConfig = bulkWriterConfig{
+	MaxItems:      500,
+	MaxBytes:      5 * 1024 * 1024,
+	FlushInterval: time.Second,
+	Refresh:       "false",
+}
+
+// Bulk settings used by every elasticsearch sink, read from the environment on startup
+var esBulkConfig = defaultBulkWriterConfig
+
+// Function to read the bulk writer settings from the environment, unset values keep their default
+func loadBulkWriterConfig() (bulkWriterConfig, error) {
+	config := defaultBulkWriterConfig
+
+	if value := os.Getenv("ES_BULK_MAX_ITEMS"); value != "" {
+		maxItems, err := strconv.Atoi(value)
+		if err != nil || maxItems <= 0 {
+			return config, fmt.Errorf("invalid ES_BULK_MAX_ITEMS %q", value)
+		}
+		config.MaxItems = maxItems
+	}
+
+	if value := os.Getenv("ES_BULK_MAX_BYTES"); value != "" {
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil || maxBytes <= 0 {
+			return config, fmt.Errorf("invalid ES_BULK_MAX_BYTES %q", value)
+		}
+		config.MaxBytes = maxBytes
+	}
+
+	if value := os.Getenv("ES_BULK_FLUSH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return config, fmt.Errorf("invalid ES_BULK_FLUSH_INTERVAL %q", value)
+		}
+		config.FlushInterval = interval
+	}
+
+	if value := os.Getenv("ES_REFRESH"); value != "" {
+		switch value {
+		case "false", "wait_for", "true":
+			config.Refresh = value
+		default:
+			return config, fmt.Errorf("invalid ES_REFRESH %q, expected false, wait_for or true", value)
+		}
+	}
+
+	return config, nil
+}
+
+// Documents of transactions whose rebuilds are still being written, counted per document id.
+// Flushes triggered by the limits or the interval keep their buffered writes back until the
+// transaction is complete, so its documents go out together. Other writes are sent as usual,
+// and a Flush call always sends the whole buffer
+type transactionGate struct {
+	sync.Mutex
+	open map[string]int
+}
+
+var pendingTransactions = &transactionGate{open: map[string]int{}}
+
+func (g *transactionGate) hold(projectIDs []int) {
+	g.Lock()
+	defer g.Unlock()
+	for _, projectID := range projectIDs {
+		g.open[strconv.Itoa(projectID)]++
+	}
+}
+
+func (g *transactionGate) release(projectIDs []int) {
+	g.Lock()
+	defer g.Unlock()
+	for _, projectID := range projectIDs {
+		id := strconv.Itoa(projectID)
+		g.open[id]--
+		if g.open[id] <= 0 {
+			delete(g.open, id)
+		}
+	}
+}
+
+func (g *transactionGate) held(id string) bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.open[id] > 0
+}
+
+// Script applying a partial update unless the stored document is newer than the update
+const versionedUpdateScript = `if (ctx._source.sync_version != null && ctx._source.sync_version > params.version) {
+	ctx.op = 'noop';
+} else {
+	for (entry in params.fields.entrySet()) {
+		ctx._source[entry.getKey()] = entry.getValue();
+	}
+	ctx._source.sync_version = params.version;
+}`
+
+// One action of a bulk request
+type bulkItem struct {
+	ID     string
+	Action []byte
+	// Document or partial update, nil for deletes
+	Body []byte
+	// Written with an external version, a version conflict means a newer write is already stored
+	Versioned bool
+}
+
+func (item *bulkItem) size() int {
+	return len(item.Action) + len(item.Body) + 2
+}
+
+// Error of a flush listing the documents that could not be written, by id
+type bulkError struct {
+	Failures map[string]error
+}
+
+func (e *bulkError) Error() string {
+	ids := make([]string, 0, len(e.Failures))
+	for id := range e.Failures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	messages := make([]string, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, e.Failures[id].Error())
+	}
+	return fmt.Sprintf("failed to write %d documents: %s", len(ids), strings.Join(messages, "; "))
+}
+
+// Writer buffering document writes and sending them with the _bulk endpoint. Failures of
+// flushes triggered by the limits or the interval are kept and reported by the next Flush
+type bulkWriter struct {
+	sync.Mutex
+	esClient  *elasticsearch.Client
+	indexName string
+	config    bulkWriterConfig
+
+	items []*bulkItem
+	// Positions of the buffered writes of each document, a full write replaces all of them
+	positions map[string][]int
+	count     int
+	bytes     int
+	timer     *time.Timer
+
+	failures map[string]error
+	flushErr error
+}
+
+func newBulkWriter(esClient *elasticsearch.Client, indexName string, config bulkWriterConfig) *bulkWriter {
+	return &bulkWriter{
+		esClient:  esClient,
+		indexName: indexName,
+		config:    config,
+		positions: map[string][]int{},
+		failures:  map[string]error{},
+	}
+}
+
+func (w *bulkWriter) index(ctx context.Context, id string, document json.RawMessage, version int64) error {
+	// The version is stored in the document as well, for the checks of partial updates
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(document, &fields); err != nil {
+		return err
+	}
+	fields[syncVersionField] = json.RawMessage(strconv.FormatInt(version, 10))
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return w.add(ctx, id, "index", externalVersion(version), body, true)
+}
+
+// Partial updates can't be externally versioned, a script compares the version stored in the document
+func (w *bulkWriter) update(ctx context.Context, id string, fields map[string]interface{}, version int64) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": versionedUpdateScript,
+			"lang":   "painless",
+			"params": map[string]interface{}{
+				"fields":  fields,
+				"version": version,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return w.add(ctx, id, "update", map[string]interface{}{"retry_on_conflict": esRetryOnConflict}, body, false)
+}
+
+func (w *bulkWriter) delete(ctx context.Context, id string, version int64) error {
+	return w.add(ctx, id, "delete", externalVersion(version), nil, true)
+}
+
+func externalVersion(version int64) map[string]interface{} {
+	return map[string]interface{}{"version": version, "version_type": "external"}
+}
+
+// Function to buffer an action. Index and delete actions replace the whole document,
+// so earlier buffered writes of the same document, partial updates included, are dropped
+func (w *bulkWriter) add(ctx context.Context, id string, actionType string, options map[string]interface{}, body []byte, replaces bool) error {
+	meta := map[string]interface{}{
+		"_index": w.indexName,
+		"_id":    id,
+	}
+	for key, value := range options {
+		meta[key] = value
+	}
+	action, err := json.Marshal(map[string]interface{}{actionType: meta})
+	if err != nil {
+		return err
+	}
+	item := &bulkItem{ID: id, Action: action, Body: body, Versioned: options["version_type"] == "external"}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if replaces {
+		for _, position := range w.positions[id] {
+			w.count--
+			w.bytes -= w.items[position].size()
+			w.items[position] = nil
+		}
+		w.positions[id] = nil
+	}
+	w.buffer(item)
+
+	if w.full() {
+		w.flushLocked(ctx, true)
+		// The held writes alone reach the limits, a transaction this large can't go out in one request anyway
+		if w.full() {
+			w.flushLocked(ctx, false)
+		}
+		return w.flushErr
+	}
+
+	if w.timer == nil {
+		w.startTimer()
+	}
+	return nil
+}
+
+// Function to append an item to the buffer. Must be called with the writer locked
+func (w *bulkWriter) buffer(item *bulkItem) {
+	w.positions[item.ID] = append(w.positions[item.ID], len(w.items))
+	w.items = append(w.items, item)
+	w.count++
+	w.bytes += item.size()
+}
+
+func (w *bulkWriter) full() bool {
+	return w.count >= w.config.MaxItems || w.bytes >= w.config.MaxBytes
+}
+
+// Function to flush the buffer once the interval has passed. Must be called with the writer locked
+func (w *bulkWriter) startTimer() {
+	var timer *time.Timer
+	timer = time.AfterFunc(w.config.FlushInterval, func() {
+		w.Lock()
+		defer w.Unlock()
+		// The buffer was flushed while this timer was waiting for the lock
+		if w.timer != timer {
+			return
+		}
+		w.flushLocked(context.Background(), true)
+	})
+	w.timer = timer
+}
+
+// Function to drop every buffered write and pending failure without sending them
+func (w *bulkWriter) discard() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.items = nil
+	w.positions = map[string][]int{}
+	w.count = 0
+	w.bytes = 0
+	w.failures = map[string]error{}
+	w.flushErr = nil
+}
+
+// Function to send every buffered write and report the failures since the last call.
+// Returns errESUnavailable if writes were dropped because elasticsearch is unhealthy,
+// or a bulkError listing the documents that failed for good
+func (w *bulkWriter) Flush(ctx context.Context) error {
+	w.Lock()
+	defer w.Unlock()
+
+	w.flushLocked(ctx, false)
+
+	err := w.flushErr
+	failures := w.failures
+	w.flushErr = nil
+	w.failures = map[string]error{}
+
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return &bulkError{Failures: failures}
+	}
+	return nil
+}
+
+// Function to send the buffered writes in requests within the limits, writes of incomplete
+// transactions stay buffered if holdTransactions is set. Must be called with the writer locked
+func (w *bulkWriter) flushLocked(ctx context.Context, holdTransactions bool) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	items := w.items
+	w.items = nil
+	w.positions = map[string][]int{}
+	w.count = 0
+	w.bytes = 0
+
+	var pending []*bulkItem
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		// All writes of a document are held together, so they stay in order
+		if holdTransactions && pendingTransactions.held(item.ID) {
+			w.buffer(item)
+			continue
+		}
+		pending = append(pending, item)
+	}
+	if w.count > 0 {
+		w.startTimer()
+	}
+
+	chunks := w.chunks(pending)
+	for i, chunk := range chunks {
+		err := w.sendChunk(ctx, chunk)
+		if errors.Is(err, errESUnavailable) {
+			w.flushErr = err
+			dropped := 0
+			for _, chunk := range chunks[i:] {
+				dropped += len(chunk)
+			}
+			log.Printf("Dropped %d buffered writes to %s: %v", dropped, w.indexName, err)
+			return
+		}
+	}
+}
+
+// Function to split writes into bulk requests of at most the item and byte limits.
+// A single write larger than the byte limit is sent on its own
+func (w *bulkWriter) chunks(items []*bulkItem) [][]*bulkItem {
+	var chunks [][]*bulkItem
+	var chunk []*bulkItem
+	size := 0
+	for _, item := range items {
+		if len(chunk) > 0 && (len(chunk) >= w.config.MaxItems || size+item.size() > w.config.MaxBytes) {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			size = 0
+		}
+		chunk = append(chunk, item)
+		size += item.size()
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Function to send one bulk request, retrying the items that fail with a retryable status.
+// Failures are recorded, errESUnavailable is returned if elasticsearch is unhealthy
+func (w *bulkWriter) sendChunk(ctx context.Context, pending []*bulkItem) error {
+	// Items failing with a retryable status are sent again on their own, the others are reported
+	err := withESRetry(ctx, func() error {
+		retry, err := w.send(ctx, pending)
+		if len(retry) > 0 {
+			pending = retry
+		}
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+
+	var itemErr *bulkItemError
+	if errors.As(err, &itemErr) {
+		// Only the items of the last attempt are still failing
+		for _, item := range pending {
+			if _, ok := w.failures[item.ID]; !ok {
+				w.failures[item.ID] = err
+			}
+		}
+		return nil
+	}
+	if errors.Is(err, errESUnavailable) {
+		return err
+	}
+	for _, item := range pending {
+		w.failures[item.ID] = err
+	}
+	return nil
+}
+
+// Error of the first failing item of a bulk request
+type bulkItemError struct {
+	*esResponseError
+}
+
+func (e *bulkItemError) Unwrap() error {
+	return e.esResponseError
+}
+
+// Function to send one bulk request. Terminal item failures are recorded right away,
+// the items to retry are returned along with the error of the first of them
+func (w *bulkWriter) send(ctx context.Context, items []*bulkItem) ([]*bulkItem, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.Action)
+		body.WriteByte('\n')
+		if item.Body != nil {
+			body.Write(item.Body)
+			body.WriteByte('\n')
+		}
+	}
+
+	req := esapi.BulkRequest{
+		Body:    &body,
+		Refresh: w.config.Refresh,
+	}
+
+	res, err := req.Do(ctx, w.esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, newESResponseError(res, "bulk request failed")
+	}
+
+	// The request succeeds as a whole even if single items fail
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	if !result.Errors {
+		return nil, nil
+	}
+
+	// Items are reported in the order of the request
+	var retry []*bulkItem
+	var retryErr error
+	for i, item := range result.Items {
+		if i >= len(items) {
+			break
+		}
+		for _, itemResult := range item {
+			if itemResult.Error == nil {
+				continue
+			}
+			// The stored document was written from newer data, the stale write is dropped
+			if itemResult.Status == 409 && items[i].Versioned {
+				continue
+			}
+			responseErr := &esResponseError{
+				StatusCode: itemResult.Status,
+				Message:    fmt.Sprintf("failed to write document %s: %s", itemResult.ID, itemResult.Error),
+			}
+			if !isRetryableESError(responseErr) {
+				w.failures[items[i].ID] = responseErr
+				continue
+			}
+			if retryErr == nil {
+				retryErr = &bulkItemError{responseErr}
+			}
+			retry = append(retry, items[i])
+		}
+	}
+	return retry, retryErr
+}
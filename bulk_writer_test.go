@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBulkWriterAdd(t *testing.T) {
+	type write struct {
+		action string
+		id     string
+	}
+
+	tests := []struct {
+		name   string
+		writes []write
+		// Actions and ids left in the buffer, in order
+		buffered []write
+	}{
+		{
+			name:     "update kept after index",
+			writes:   []write{{"index", "1"}, {"update", "1"}},
+			buffered: []write{{"index", "1"}, {"update", "1"}},
+		},
+		{
+			name:     "index drops buffered updates",
+			writes:   []write{{"update", "1"}, {"update", "2"}, {"update", "1"}, {"index", "1"}},
+			buffered: []write{{"update", "2"}, {"index", "1"}},
+		},
+		{
+			name:     "delete drops buffered writes",
+			writes:   []write{{"index", "1"}, {"update", "1"}, {"delete", "1"}},
+			buffered: []write{{"delete", "1"}},
+		},
+		{
+			name:     "index after delete",
+			writes:   []write{{"delete", "1"}, {"update", "2"}, {"index", "1"}, {"update", "1"}},
+			buffered: []write{{"update", "2"}, {"index", "1"}, {"update", "1"}},
+		},
+	}
+
+	ctx := context.Background()
+	config := bulkWriterConfig{MaxItems: 100, MaxBytes: 1024 * 1024, FlushInterval: time.Hour, Refresh: "false"}
+	for _, test := range tests {
+		// Nothing reaches the limits, so no request is sent
+		w := newBulkWriter(nil, "projects_v1", config)
+		for _, write := range test.writes {
+			var err error
+			switch write.action {
+			case "index":
+				err = w.index(ctx, write.id, []byte(`{"name":"fold"}`), 1)
+			case "update":
+				err = w.update(ctx, write.id, map[string]interface{}{"name": "fold"}, 1)
+			case "delete":
+				err = w.delete(ctx, write.id, 1)
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+		}
+
+		var buffered []write
+		bytes := 0
+		for _, item := range w.items {
+			if item == nil {
+				continue
+			}
+			var action map[string]json.RawMessage
+			if err := json.Unmarshal(item.Action, &action); err != nil {
+				t.Fatalf("%s: invalid action %s: %v", test.name, item.Action, err)
+			}
+			for actionType := range action {
+				buffered = append(buffered, write{actionType, item.ID})
+			}
+			bytes += item.size()
+		}
+		if !reflect.DeepEqual(buffered, test.buffered) {
+			t.Errorf("%s: got buffered writes %v, want %v", test.name, buffered, test.buffered)
+		}
+		if w.count != len(test.buffered) || w.bytes != bytes {
+			t.Errorf("%s: got %d items of %d bytes, want %d of %d", test.name, w.count, w.bytes, len(test.buffered), bytes)
+		}
+		w.discard()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Number of dead letters listed per page unless a limit is given
+const deadLettersPageSize = 50
+
+// A change event that failed to sync, kept until it is retried successfully or discarded
+type deadLetter struct {
+	ID            int64           `json:"id"`
+	Payload       json.RawMessage `json:"payload"`
+	Error         string          `json:"error"`
+	Attempts      int             `json:"attempts"`
+	CreatedAt     time.Time       `json:"created_at"`
+	LastAttemptAt time.Time       `json:"last_attempt_at"`
+}
+
+func insertDeadLetter(pgDB *sql.DB, event ChangeEvent, syncErr error) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = pgDB.Exec("INSERT INTO sync_dead_letters (payload, error) VALUES ($1, $2)", payload, syncErr.Error())
+	return err
+}
+
+// Function to list dead letters, oldest first
+func listDeadLetters(pgDB *sql.DB, limit int, offset int) ([]deadLetter, error) {
+	rows, err := pgDB.Query(`
+		SELECT id, payload, error, attempts, created_at, last_attempt_at
+		FROM sync_dead_letters
+		ORDER BY id
+		LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []deadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, letter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// Function to fetch a single dead letter, returns sql.ErrNoRows if it doesn't exist
+func getDeadLetter(pgDB *sql.DB, id int64) (deadLetter, error) {
+	row := pgDB.QueryRow(`
+		SELECT id, payload, error, attempts, created_at, last_attempt_at
+		FROM sync_dead_letters
+		WHERE id = $1`, id)
+	return scanDeadLetter(row)
+}
+
+// Function to fetch several dead letters, oldest first. Letters that don't exist are left out
+func getDeadLetters(pgDB *sql.DB, ids []int64) ([]deadLetter, error) {
+	rows, err := pgDB.Query(`
+		SELECT id, payload, error, attempts, created_at, last_attempt_at
+		FROM sync_dead_letters
+		WHERE id = ANY($1)
+		ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deadLetters []deadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, letter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (deadLetter, error) {
+	var letter deadLetter
+	var payload []byte
+	err := row.Scan(&letter.ID, &payload, &letter.Error, &letter.Attempts, &letter.CreatedAt, &letter.LastAttemptAt)
+	letter.Payload = payload
+	return letter, err
+}
+
+func updateDeadLetterAttempt(pgDB *sql.DB, id int64, syncErr error) error {
+	_, err := pgDB.Exec(`
+		UPDATE sync_dead_letters
+		SET attempts = attempts + 1, error = $2, last_attempt_at = NOW()
+		WHERE id = $1`, id, syncErr.Error())
+	return err
+}
+
+func listDeadLetterIDs(pgDB *sql.DB) ([]int64, error) {
+	rows, err := pgDB.Query("SELECT id FROM sync_dead_letters ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Function to remove a dead letter, returns sql.ErrNoRows if it doesn't exist
+func discardDeadLetter(pgDB *sql.DB, id int64) error {
+	result, err := pgDB.Exec("DELETE FROM sync_dead_letters WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -2,39 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
 
-// Function to create missing elasticsearch mappings
-func createElasticSearchMappings(esClient *elasticsearch.Client) error {
+// Function to create missing elasticsearch mappings.
+// projects_mapping_index is an alias over a versioned physical index such as projects_v1
+func createElasticSearchMappings(pgDB *sql.DB, esClient *elasticsearch.Client) error {
 	ctx := context.Background()
 
-	// Define the Elasticsearch index mappings for projects
-	projectsMapping := `
-	{
-        "mappings": {
-            "properties": {
-                "id": { "type": "integer" },
-                "name": { "type": "text" },
-                "slug": { "type": "text" },
-                "description": { "type": "text" },
-                "created_at": { "type": "date" },
-                "users": {
-                    "type": "nested",
-                    "properties": {
-                        "id": { "type": "integer" },
-                        "name": { "type": "text" },
-						"created_at": { "type": "date" }
-                    }
-                },
-                "hashtags": { "type": "keyword" }
-            }
-        }
-    }`
+	// Check if the alias already exists
+	indices, err := getAliasIndices(ctx, esClient, projects_mapping_index)
+	if err != nil {
+		log.Printf("Error checking alias existence: %v", err)
+		return err
+	}
+	if len(indices) > 0 {
+		log.Printf("Alias %s already exists over %v.", projects_mapping_index, indices)
+		return migrateOutdatedProjectsMapping(ctx, pgDB, esClient)
+	}
 
 	// Check if index already exists
 	exists, err := indexExists(ctx, esClient, projects_mapping_index)
@@ -43,21 +38,126 @@ func createElasticSearchMappings(esClient *elasticsearch.Client) error {
 		return err
 	}
 
-	// Create index with mappings in Elasticsearch if it doesn't exist
-	if !exists {
-		err = createIndexWithMapping(ctx, esClient, projects_mapping_index, projectsMapping)
-		if err != nil {
-			log.Printf("Error creating index %s: %v", projects_mapping_index, err)
-		} else {
-			log.Printf("Index %s created.", projects_mapping_index)
-		}
-	} else {
-		log.Printf("Index %s already exists.", projects_mapping_index)
+	// An index created before aliases were introduced is moved behind the alias
+	if exists {
+		return migrateIndexToAlias(ctx, esClient, projects_mapping_index, projectsIndexName(1))
 	}
 
+	// Create the first version with mappings in Elasticsearch and point the alias to it
+	indexName := projectsIndexName(1)
+	err = createProjectsIndex(ctx, esClient, indexName)
+	if err != nil {
+		log.Printf("Error creating index %s: %v", indexName, err)
+		return err
+	}
+	err = updateAliases(ctx, esClient, []map[string]interface{}{
+		{"add": map[string]interface{}{"index": indexName, "alias": projects_mapping_index}},
+	})
+	if err != nil {
+		log.Printf("Error creating alias %s: %v", projects_mapping_index, err)
+		return err
+	}
+	log.Printf("Index %s created behind alias %s.", indexName, projects_mapping_index)
+
 	return nil
 }
 
+// Function to compute the checksum of the projects mapping generated from the pipeline spec.
+// Key order doesn't change it
+func projectsMappingChecksum() (string, error) {
+	canonical, err := json.Marshal(pipeline.mapping())
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Function to create a projects index whose _meta records the checksum of the mapping it was created with
+func createProjectsIndex(ctx context.Context, esClient *elasticsearch.Client, indexName string) error {
+	checksum, err := projectsMappingChecksum()
+	if err != nil {
+		return err
+	}
+
+	body := pipeline.mapping()
+	body["mappings"].(map[string]interface{})["_meta"] = map[string]interface{}{"mapping_checksum": checksum}
+
+	mapping, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return createIndexWithMapping(ctx, esClient, indexName, string(mapping))
+}
+
+// Function to compare the mapping checksum of the indices behind the alias with the expected one.
+// Outdated indices are migrated with a reindex, unless ES_MAPPING_MIGRATION is set to refuse
+func migrateOutdatedProjectsMapping(ctx context.Context, pgDB *sql.DB, esClient *elasticsearch.Client) error {
+	expected, err := projectsMappingChecksum()
+	if err != nil {
+		return err
+	}
+
+	checksums, err := getMappingChecksums(ctx, esClient, projects_mapping_index)
+	if err != nil {
+		return err
+	}
+
+	var outdated []string
+	for indexName, checksum := range checksums {
+		if checksum != expected {
+			outdated = append(outdated, indexName)
+		}
+	}
+	if len(outdated) == 0 {
+		return nil
+	}
+
+	if os.Getenv("ES_MAPPING_MIGRATION") == "refuse" {
+		return fmt.Errorf("indices %v behind alias %s don't have the expected mapping (checksum %s), "+
+			"unset ES_MAPPING_MIGRATION to migrate them by reindexing from postgres", outdated, projects_mapping_index, expected)
+	}
+
+	log.Printf("Indices %v have an outdated mapping, migrating to checksum %s.", outdated, expected)
+	return reindexProjects(pgDB, esClient)
+}
+
+// Function to read the mapping checksum stored in the _meta of every index behind an alias.
+// Indices created without a checksum are reported with an empty one
+func getMappingChecksums(ctx context.Context, esClient *elasticsearch.Client, alias string) (map[string]string, error) {
+	req := esapi.IndicesGetMappingRequest{
+		Index: []string{alias},
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("get mapping failed: %s", res.String())
+	}
+
+	var result map[string]struct {
+		Mappings struct {
+			Meta struct {
+				MappingChecksum string `json:"mapping_checksum"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[string]string, len(result))
+	for indexName, index := range result {
+		checksums[indexName] = index.Mappings.Meta.MappingChecksum
+	}
+	return checksums, nil
+}
+
 func indexExists(ctx context.Context, esClient *elasticsearch.Client, indexName string) (bool, error) {
 	res, err := esapi.IndicesExistsRequest{Index: []string{indexName}}.Do(ctx, esClient)
 	if err != nil {
@@ -83,7 +183,7 @@ func createIndexWithMapping(ctx context.Context, esClient *elasticsearch.Client,
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return err
+		return fmt.Errorf("create index failed: %s", res.String())
 	}
 	return nil
 }
@@ -91,15 +191,15 @@ func createIndexWithMapping(ctx context.Context, esClient *elasticsearch.Client,
 func clearElasticsearchIndices(esClient *elasticsearch.Client) {
 	ctx := context.Background()
 
-	indicesToClear := []string{
-		projects_mapping_index,
+	// Indices behind an alias can only be deleted by their concrete names
+	indicesToClear, err := getAliasIndices(ctx, esClient, projects_mapping_index)
+	if err != nil {
+		log.Printf("Error resolving alias %s: %v", projects_mapping_index, err)
+		return
 	}
 
 	for _, indexName := range indicesToClear {
-		req := esapi.IndicesDeleteRequest{
-			Index: []string{indexName},
-		}
-		_, err := req.Do(ctx, esClient)
+		err := deleteIndex(ctx, esClient, indexName)
 		if err != nil {
 			log.Printf("Error deleting index %s: %v", indexName, err)
 		} else {
@@ -107,3 +207,19 @@ func clearElasticsearchIndices(esClient *elasticsearch.Client) {
 		}
 	}
 }
+
+func deleteIndex(ctx context.Context, esClient *elasticsearch.Client, indexName string) error {
+	req := esapi.IndicesDeleteRequest{
+		Index: []string{indexName},
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("delete index failed: %s", res.String())
+	}
+	return nil
+}
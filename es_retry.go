@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// Attempts made for a single elasticsearch write before giving up
+const esMaxAttempts = 5
+
+// Backoff between attempts, doubled after each failure and jittered
+const esRetryBaseDelay = 200 * time.Millisecond
+const esRetryMaxDelay = 10 * time.Second
+
+// Retries elasticsearch makes itself when an update hits a version conflict
+const esRetryOnConflict = 3
+
+// Consecutive unhealthy responses after which writes are paused, and for how long
+const esBreakerThreshold = 5
+const esBreakerCooldown = 30 * time.Second
+
+// Returned while elasticsearch is considered unhealthy. Events failing with it
+// are not consumed, they are delivered again once elasticsearch recovers
+var errESUnavailable = errors.New("elasticsearch unavailable")
+
+var esBreaker = &circuitBreaker{threshold: esBreakerThreshold, cooldown: esBreakerCooldown}
+
+// Error response of an elasticsearch request
+type esResponseError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *esResponseError) Error() string {
+	return e.Message
+}
+
+func newESResponseError(res *esapi.Response, message string) error {
+	return &esResponseError{StatusCode: res.StatusCode, Message: fmt.Sprintf("%s: %s", message, res.Status())}
+}
+
+// Function to classify errors worth another attempt. Transport errors, back-pressure,
+// version conflicts and server errors are retried, other client errors are terminal
+func isRetryableESError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var responseErr *esResponseError
+	if !errors.As(err, &responseErr) {
+		return true
+	}
+	switch responseErr.StatusCode {
+	case 408, 409, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// Function to tell whether an error says elasticsearch itself is unhealthy,
+// as opposed to a problem with a single request
+func isUnhealthyESError(err error) bool {
+	var responseErr *esResponseError
+	if !errors.As(err, &responseErr) {
+		return isRetryableESError(err)
+	}
+	return responseErr.StatusCode == 429 || responseErr.StatusCode >= 500
+}
+
+// Function to run an elasticsearch write with jittered exponential backoff
+func withESRetry(ctx context.Context, write func() error) error {
+	delay := esRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		if !esBreaker.allow() {
+			return errESUnavailable
+		}
+
+		err := write()
+		if err == nil {
+			esBreaker.success()
+			return nil
+		}
+
+		unhealthy := isUnhealthyESError(err)
+		if unhealthy {
+			esBreaker.failure()
+		}
+		if !isRetryableESError(err) {
+			return err
+		}
+		if attempt == esMaxAttempts {
+			if unhealthy {
+				return fmt.Errorf("%w: %v", errESUnavailable, err)
+			}
+			return err
+		}
+
+		// Sleep between half and the full delay so concurrent writers spread out
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+
+		delay *= 2
+		if delay > esRetryMaxDelay {
+			delay = esRetryMaxDelay
+		}
+	}
+}
+
+// Circuit breaker opened after a run of consecutive failures. While open, writes
+// fail fast, once the cooldown is over the next write decides whether it closes again
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// Function to block until the breaker lets writes through again
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	b.Lock()
+	remaining := time.Until(b.openUntil)
+	b.Unlock()
+	if remaining <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(remaining):
+		return nil
+	}
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures >= b.threshold {
+		log.Printf("Elasticsearch recovered, resuming sync")
+	}
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		// A failed trial after the cooldown opens the breaker again right away
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("Elasticsearch unhealthy after %d failures, pausing sync for %s", b.failures, b.cooldown)
+	}
+}
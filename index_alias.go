@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// Prefix of the versioned physical indices behind the projects alias
+const projectsIndexPrefix = "projects_v"
+
+func projectsIndexName(version int) string {
+	return fmt.Sprintf("%s%d", projectsIndexPrefix, version)
+}
+
+func projectsIndexVersion(indexName string) int {
+	version, err := strconv.Atoi(strings.TrimPrefix(indexName, projectsIndexPrefix))
+	if err != nil || !strings.HasPrefix(indexName, projectsIndexPrefix) {
+		return 0
+	}
+	return version
+}
+
+// Sinks written by live sync. Normally only the configured sink, while a reindex is
+// building a new version the new index is written as well
+type projectsIndexState struct {
+	// Held by live sync while it applies an event, and by a reindex while it swaps the alias
+	sync.Mutex
+	// The configured sink comes first
+	sinks []Sink
+	// Projects synced since the reindex started, nil when no reindex is running
+	touched map[int]bool
+}
+
+var projectsIndex = &projectsIndexState{}
+
+// Function to list the concrete indices an alias points to. Returns no indices if the alias doesn't exist
+func getAliasIndices(ctx context.Context, esClient *elasticsearch.Client, alias string) ([]string, error) {
+	req := esapi.IndicesGetAliasRequest{
+		Name: []string{alias},
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("get alias failed: %s", res.String())
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	indices := make([]string, 0, len(result))
+	for indexName := range result {
+		indices = append(indices, indexName)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// Function to apply alias actions. Elasticsearch applies all actions of a request atomically
+func updateAliases(ctx context.Context, esClient *elasticsearch.Client, actions []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: bytes.NewReader(body),
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("update aliases failed: %s", res.String())
+	}
+	return nil
+}
+
+// Function to move a concrete index created before aliases were introduced behind the alias of the same name
+func migrateIndexToAlias(ctx context.Context, esClient *elasticsearch.Client, legacyIndex string, indexName string) error {
+	err := createProjectsIndex(ctx, esClient, indexName)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"source": map[string]interface{}{"index": legacyIndex},
+		"dest":   map[string]interface{}{"index": indexName},
+	})
+	if err != nil {
+		return err
+	}
+
+	waitForCompletion := true
+	refresh := true
+	req := esapi.ReindexRequest{
+		Body:              bytes.NewReader(body),
+		WaitForCompletion: &waitForCompletion,
+		Refresh:           &refresh,
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("reindex of %s failed: %s", legacyIndex, res.String())
+	}
+
+	// Dropping the legacy index and adding the alias happen in one atomic step
+	err = updateAliases(ctx, esClient, []map[string]interface{}{
+		{"add": map[string]interface{}{"index": indexName, "alias": legacyIndex}},
+		{"remove_index": map[string]interface{}{"index": legacyIndex}},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Index %s moved to %s behind alias %s.", legacyIndex, indexName, legacyIndex)
+	return nil
+}
+
+// Function to rebuild the projects alias on a new physical index without downtime.
+//
+// The new index is created and added to the live sync write targets, then filled from a
+// postgres snapshot. Projects synced by live sync while the snapshot was being indexed are
+// rebuilt once more with live sync paused, so the snapshot never overwrites newer data.
+// Finally the alias is swapped atomically and the old indices are deleted
+func reindexProjects(pgDB *sql.DB, esClient *elasticsearch.Client) error {
+	ctx := context.Background()
+
+	oldIndices, err := getAliasIndices(ctx, esClient, projects_mapping_index)
+	if err != nil {
+		return err
+	}
+
+	// Indices left behind by failed reindexes count too, the new version must not exist yet
+	existingIndices, err := listProjectsIndices(ctx, esClient)
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	for _, indexName := range append(oldIndices, existingIndices...) {
+		if v := projectsIndexVersion(indexName); v > version {
+			version = v
+		}
+	}
+	newIndex := projectsIndexName(version + 1)
+
+	err = createProjectsIndex(ctx, esClient, newIndex)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reindexing %s into %s.", projects_mapping_index, newIndex)
+
+	// Start dual writes before the snapshot is taken so no change is missed
+	newSink := newElasticsearchSink(esClient, newIndex)
+	projectsIndex.Lock()
+	projectsIndex.sinks = append(projectsIndex.sinks[:1:1], newSink)
+	projectsIndex.touched = map[int]bool{}
+	projectsIndex.Unlock()
+
+	_, err = indexProjectsSnapshot(ctx, pgDB, newSink)
+	if err != nil {
+		projectsIndex.Lock()
+		abortReindex(ctx, esClient, newSink)
+		projectsIndex.Unlock()
+		return err
+	}
+
+	projectsIndex.Lock()
+	defer projectsIndex.Unlock()
+
+	// Projects changed during the snapshot may have been overwritten with their snapshot state
+	err = rebuildTouchedProjects(pgDB, newSink)
+	if err != nil {
+		abortReindex(ctx, esClient, newSink)
+		return err
+	}
+
+	// Every write has to be in the new index before it goes live
+	err = newSink.Flush(ctx)
+	if err != nil {
+		abortReindex(ctx, esClient, newSink)
+		return err
+	}
+
+	actions := []map[string]interface{}{
+		{"add": map[string]interface{}{"index": newIndex, "alias": projects_mapping_index}},
+	}
+	for _, indexName := range oldIndices {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": indexName, "alias": projects_mapping_index}})
+	}
+	err = updateAliases(ctx, esClient, actions)
+	if err != nil {
+		abortReindex(ctx, esClient, newSink)
+		return err
+	}
+
+	projectsIndex.sinks = projectsIndex.sinks[:1]
+	projectsIndex.touched = nil
+	log.Printf("Alias %s swapped to %s.", projects_mapping_index, newIndex)
+
+	// Retire the old versions
+	for _, indexName := range oldIndices {
+		err := deleteIndex(ctx, esClient, indexName)
+		if err != nil {
+			log.Printf("Error deleting index %s: %v", indexName, err)
+		}
+	}
+
+	return nil
+}
+
+// Function to rebuild the projects synced during a reindex in batches, live sync is paused meanwhile.
+// Must be called with projectsIndex locked
+func rebuildTouchedProjects(pgDB *sql.DB, sink Sink) error {
+	projectIDs := make([]int, 0, len(projectsIndex.touched))
+	for projectID := range projectsIndex.touched {
+		projectIDs = append(projectIDs, projectID)
+	}
+	sort.Ints(projectIDs)
+
+	version, err := currentSyncVersion(pgDB)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(projectIDs); start += syncBatchSize {
+		end := start + syncBatchSize
+		if end > len(projectIDs) {
+			end = len(projectIDs)
+		}
+		batch := projectIDs[start:end]
+
+		documents, err := buildProjectDocuments(pgDB, batch)
+		if err != nil {
+			return fmt.Errorf("failed to build projects %v: %w", batch, err)
+		}
+		// Projects missing from postgres were deleted, their documents are removed
+		for _, projectID := range batch {
+			err := writeProjectToSink(sink, projectID, documents[projectID], version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Function to stop dual writes and drop the partially built index. Must be called with projectsIndex locked
+func abortReindex(ctx context.Context, esClient *elasticsearch.Client, newSink *elasticsearchSink) {
+	projectsIndex.sinks = projectsIndex.sinks[:1]
+	projectsIndex.touched = nil
+
+	// Buffered writes would recreate the index with a dynamic mapping once deleted
+	newSink.writer.discard()
+
+	err := deleteIndex(ctx, esClient, newSink.indexName)
+	if err != nil {
+		log.Printf("Error deleting index %s: %v", newSink.indexName, err)
+	}
+}
+
+// Function to write every project of a postgres snapshot to the given sink, returns how many were written
+func indexProjectsSnapshot(ctx context.Context, pgDB *sql.DB, sink Sink) (int, error) {
+	tx, err := pgDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The first statement of the transaction takes the snapshot, the documents are versioned with it
+	version, err := currentSyncVersion(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	lastID := 0
+	for {
+		documents, err := buildProjectDocumentPage(tx, lastID, backfillPageSize, version)
+		if err != nil {
+			return 0, err
+		}
+		if len(documents) == 0 {
+			break
+		}
+
+		err = sink.UpsertDocuments(ctx, documents)
+		if err != nil {
+			return 0, fmt.Errorf("failed to index projects after id %d: %v", lastID, err)
+		}
+		indexed += len(documents)
+		lastID = documents[len(documents)-1].ID
+	}
+
+	err = sink.Flush(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return indexed, tx.Commit()
+}
+
+// Function to list every versioned projects index, whether the alias points to it or not
+func listProjectsIndices(ctx context.Context, esClient *elasticsearch.Client) ([]string, error) {
+	req := esapi.IndicesGetRequest{
+		Index:           []string{projectsIndexPrefix + "*"},
+		ExpandWildcards: "all",
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("list indices failed: %s", res.String())
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	indices := make([]string, 0, len(result))
+	for indexName := range result {
+		indices = append(indices, indexName)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
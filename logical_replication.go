@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Publication and slot used when changes are captured through logical replication instead of triggers
+const replicationPublication = "fold_sync_publication"
+const replicationSlot = "fold_sync_slot"
+
+// Maximum number of messages decoded per poll of the replication slot, begin, commit and
+// relation messages count as well as row changes
+const replicationBatchSize = 1000
+
+// Interval at which the replication slot is polled once it has been drained
+const replicationPollInterval = 1 * time.Second
+
+type replicationRelation struct {
+	Name    string
+	Columns []string
+}
+
+// Function to create the publication and the replication slot if they don't exist yet
+func setupLogicalReplication(pgDB *sql.DB) error {
+	var exists bool
+	err := pgDB.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", replicationPublication).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = pgDB.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", replicationPublication, strings.Join(pipeline.tables(), ", ")))
+		if err != nil {
+			return err
+		}
+		log.Printf("Publication %s created.", replicationPublication)
+	}
+
+	err = pgDB.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", replicationSlot).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = pgDB.Exec("SELECT pg_create_logical_replication_slot($1, 'pgoutput')", replicationSlot)
+		if err != nil {
+			return err
+		}
+		log.Printf("Replication slot %s created.", replicationSlot)
+	}
+
+	return nil
+}
+
+// Source reading row changes from a logical replication slot
+type replicationSource struct {
+	pgDB    *sql.DB
+	decoder *pgoutputDecoder
+}
+
+func newReplicationSource(pgDB *sql.DB) *replicationSource {
+	return &replicationSource{
+		pgDB:    pgDB,
+		decoder: &pgoutputDecoder{relations: map[uint32]replicationRelation{}},
+	}
+}
+
+func (s *replicationSource) Run(ctx context.Context, handler ChangeHandler) error {
+	err := setupLogicalReplication(s.pgDB)
+	if err != nil {
+		return fmt.Errorf("error setting up logical replication: %v", err)
+	}
+
+	for {
+		messages, err := s.processSlot(handler)
+		if err != nil {
+			log.Printf("Error processing replication slot: %v", err)
+		}
+
+		// Keep reading while the slot has a backlog, otherwise wait for new changes
+		if err != nil || messages < replicationBatchSize {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(replicationPollInterval):
+			}
+		}
+	}
+}
+
+// Function to hand the pending changes of the replication slot to the handler. The confirmed LSN is
+// persisted by advancing the slot past every fully handled and flushed transaction, so a failure
+// or a restart replays at most the transaction that was in progress. Returns the number of messages read
+func (s *replicationSource) processSlot(handler ChangeHandler) (int, error) {
+	rows, err := s.pgDB.Query(`
+		SELECT data
+		FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)`,
+		replicationSlot, replicationBatchSize, replicationPublication)
+	if err != nil {
+		return 0, err
+	}
+
+	// The change limit is only checked at commits, so the batch holds complete transactions.
+	// Read the whole batch first so the connection is free for the document rebuilds
+	var messages [][]byte
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var confirmedLSN uint64
+	for _, data := range messages {
+		change, commitLSN, decodeErr := s.decoder.decode(data)
+		if decodeErr != nil {
+			err = decodeErr
+			break
+		}
+
+		if change != nil {
+			err = handler.Handle(*change)
+			if err != nil {
+				break
+			}
+		}
+
+		if commitLSN != 0 {
+			confirmedLSN = commitLSN
+		}
+	}
+
+	// The transaction read partly is delivered again from its start, only complete ones are flushed
+	if err != nil && s.decoder.inTransaction {
+		handler.Discard(s.decoder.txID)
+		s.decoder.inTransaction = false
+	}
+
+	if confirmedLSN != 0 {
+		flushErr := handler.Flush()
+		if flushErr != nil {
+			return len(messages), flushErr
+		}
+
+		_, advanceErr := s.pgDB.Exec("SELECT pg_replication_slot_advance($1, $2::pg_lsn)", replicationSlot, formatLSN(confirmedLSN))
+		if advanceErr != nil && err == nil {
+			err = advanceErr
+		}
+	}
+
+	return len(messages), err
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// Decoder for the pgoutput logical replication protocol, version 1
+type pgoutputDecoder struct {
+	relations map[uint32]replicationRelation
+
+	// Transaction of the changes being decoded, taken from the last begin message
+	txID          int64
+	seq           int
+	commitTime    time.Time
+	inTransaction bool
+}
+
+// Replication timestamps count microseconds since the postgres epoch
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Function to decode one pgoutput message. Returns the row change for insert, update
+// and delete messages, and the end LSN of the transaction for commit messages.
+// Unchanged TOAST columns are left out of the row images
+func (d *pgoutputDecoder) decode(data []byte) (*ChangeEvent, uint64, error) {
+	r := &pgoutputReader{data: data}
+
+	switch messageType := r.byte1(); messageType {
+	case 'R':
+		relationID := r.uint32()
+		namespace := r.cstring()
+		relation := replicationRelation{Name: r.cstring()}
+		r.byte1() // replica identity
+		columnCount := int(r.uint16())
+		for i := 0; i < columnCount && r.err == nil; i++ {
+			r.byte1() // flags
+			relation.Columns = append(relation.Columns, r.cstring())
+			r.uint32() // type oid
+			r.uint32() // type modifier
+		}
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		if namespace != "public" {
+			relation.Name = namespace + "." + relation.Name
+		}
+		d.relations[relationID] = relation
+		return nil, 0, nil
+	case 'B':
+		r.uint64() // final LSN
+		commitTime := int64(r.uint64())
+		txID := r.uint32()
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		d.txID = int64(txID)
+		d.inTransaction = true
+		d.seq = 0
+		d.commitTime = postgresEpoch.Add(time.Duration(commitTime) * time.Microsecond)
+		return nil, 0, nil
+	case 'C':
+		r.byte1()  // flags
+		r.uint64() // commit LSN
+		endLSN := r.uint64()
+		d.inTransaction = false
+		return nil, endLSN, r.err
+	case 'I', 'U', 'D':
+		relation, ok := d.relations[r.uint32()]
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		if !ok {
+			return nil, 0, fmt.Errorf("change for unknown relation")
+		}
+
+		d.seq++
+		change := &ChangeEvent{Table: relation.Name, TxID: d.txID, Seq: d.seq, CommitTime: d.commitTime}
+		switch messageType {
+		case 'I':
+			change.Operation = "INSERT"
+		case 'U':
+			change.Operation = "UPDATE"
+		case 'D':
+			change.Operation = "DELETE"
+		}
+
+		// Each tuple is prefixed by K (key columns) or O (old row) for old images, N for new images
+		for r.err == nil && r.pos < len(r.data) {
+			switch kind := r.byte1(); kind {
+			case 'K', 'O':
+				change.OldRow = r.tuple(relation)
+			case 'N':
+				change.NewRow = r.tuple(relation)
+			default:
+				return nil, 0, fmt.Errorf("unexpected tuple kind %q", kind)
+			}
+		}
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		return change, 0, nil
+	case 'T':
+		log.Printf("Ignoring replicated TRUNCATE, run a reindex to resync the affected projects")
+		return nil, 0, nil
+	default:
+		// Origin and type messages carry nothing to sync
+		return nil, 0, nil
+	}
+}
+
+type pgoutputReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pgoutputReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("pgoutput message truncated")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *pgoutputReader) byte1() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *pgoutputReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *pgoutputReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *pgoutputReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *pgoutputReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	for i := r.pos; i < len(r.data); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.pos:i])
+			r.pos = i + 1
+			return s
+		}
+	}
+	r.err = fmt.Errorf("pgoutput string not terminated")
+	return ""
+}
+
+func (r *pgoutputReader) tuple(relation replicationRelation) map[string]string {
+	row := map[string]string{}
+	columnCount := int(r.uint16())
+	for i := 0; i < columnCount && r.err == nil; i++ {
+		kind := r.byte1()
+		if kind != 't' {
+			// n is NULL and u is an unchanged TOAST value, neither carries data
+			continue
+		}
+		value := r.next(int(r.uint32()))
+		if i < len(relation.Columns) {
+			row[relation.Columns[i]] = string(value)
+		}
+	}
+	return row
+}
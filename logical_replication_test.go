@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builder for pgoutput messages in the layout of protocol version 1
+type pgoutputMessage struct {
+	bytes.Buffer
+}
+
+func newPgoutputMessage(messageType byte) *pgoutputMessage {
+	m := &pgoutputMessage{}
+	m.WriteByte(messageType)
+	return m
+}
+
+func (m *pgoutputMessage) uint16(v uint16) *pgoutputMessage {
+	binary.Write(&m.Buffer, binary.BigEndian, v)
+	return m
+}
+
+func (m *pgoutputMessage) uint32(v uint32) *pgoutputMessage {
+	binary.Write(&m.Buffer, binary.BigEndian, v)
+	return m
+}
+
+func (m *pgoutputMessage) uint64(v uint64) *pgoutputMessage {
+	binary.Write(&m.Buffer, binary.BigEndian, v)
+	return m
+}
+
+func (m *pgoutputMessage) cstring(s string) *pgoutputMessage {
+	m.WriteString(s)
+	m.WriteByte(0)
+	return m
+}
+
+func (m *pgoutputMessage) byte1(b byte) *pgoutputMessage {
+	m.WriteByte(b)
+	return m
+}
+
+// Function to append a tuple, nil values are NULL and "\x00toast" stands for an unchanged TOAST value
+func (m *pgoutputMessage) tuple(kind byte, values ...*string) *pgoutputMessage {
+	m.WriteByte(kind)
+	m.uint16(uint16(len(values)))
+	for _, value := range values {
+		switch {
+		case value == nil:
+			m.WriteByte('n')
+		case *value == unchangedToast:
+			m.WriteByte('u')
+		default:
+			m.WriteByte('t')
+			m.uint32(uint32(len(*value)))
+			m.WriteString(*value)
+		}
+	}
+	return m
+}
+
+const unchangedToast = "\x00toast"
+
+func text(s string) *string {
+	return &s
+}
+
+func dropLast(data []byte, n int) []byte {
+	return data[:len(data)-n]
+}
+
+func relationMessage(relationID uint32, namespace string, name string, columns ...string) []byte {
+	m := newPgoutputMessage('R').uint32(relationID).cstring(namespace).cstring(name).byte1('d').uint16(uint16(len(columns)))
+	for i, column := range columns {
+		flags := byte(0)
+		if i == 0 {
+			flags = 1 // part of the key
+		}
+		m.byte1(flags).cstring(column).uint32(23).uint32(0xFFFFFFFF)
+	}
+	return m.Bytes()
+}
+
+func TestPgoutputDecoder(t *testing.T) {
+	commitTime := time.Date(2023, time.October, 17, 10, 0, 0, 0, time.UTC)
+	commitMicros := uint64(commitTime.Sub(postgresEpoch) / time.Microsecond)
+
+	decoder := &pgoutputDecoder{relations: map[uint32]replicationRelation{}}
+
+	tests := []struct {
+		name      string
+		message   []byte
+		change    *ChangeEvent
+		commitLSN uint64
+	}{
+		{
+			name:    "relation",
+			message: relationMessage(16384, "public", "projects", "id", "name", "description"),
+		},
+		{
+			name:    "relation outside public",
+			message: relationMessage(16390, "audit", "projects", "id"),
+		},
+		{
+			name:    "begin",
+			message: newPgoutputMessage('B').uint64(0x16B3748).uint64(commitMicros).uint32(742).Bytes(),
+		},
+		{
+			name: "insert",
+			message: newPgoutputMessage('I').uint32(16384).
+				tuple('N', text("1"), text("fold"), nil).Bytes(),
+			change: &ChangeEvent{
+				Table: "projects", Operation: "INSERT", TxID: 742, Seq: 1, CommitTime: commitTime,
+				NewRow: map[string]string{"id": "1", "name": "fold"},
+			},
+		},
+		{
+			name: "update without old image",
+			message: newPgoutputMessage('U').uint32(16384).
+				tuple('N', text("1"), text("fold finance"), text(unchangedToast)).Bytes(),
+			change: &ChangeEvent{
+				Table: "projects", Operation: "UPDATE", TxID: 742, Seq: 2, CommitTime: commitTime,
+				NewRow: map[string]string{"id": "1", "name": "fold finance"},
+			},
+		},
+		{
+			name: "update of the key",
+			message: newPgoutputMessage('U').uint32(16384).
+				tuple('K', text("1"), nil, nil).
+				tuple('N', text("2"), text("fold finance"), text(unchangedToast)).Bytes(),
+			change: &ChangeEvent{
+				Table: "projects", Operation: "UPDATE", TxID: 742, Seq: 3, CommitTime: commitTime,
+				OldRow: map[string]string{"id": "1"},
+				NewRow: map[string]string{"id": "2", "name": "fold finance"},
+			},
+		},
+		{
+			name: "update with full old row",
+			message: newPgoutputMessage('U').uint32(16384).
+				tuple('O', text("2"), text("fold finance"), text("old")).
+				tuple('N', text("2"), text("fold"), nil).Bytes(),
+			change: &ChangeEvent{
+				Table: "projects", Operation: "UPDATE", TxID: 742, Seq: 4, CommitTime: commitTime,
+				OldRow: map[string]string{"id": "2", "name": "fold finance", "description": "old"},
+				NewRow: map[string]string{"id": "2", "name": "fold"},
+			},
+		},
+		{
+			name: "delete",
+			message: newPgoutputMessage('D').uint32(16384).
+				tuple('K', text("2"), nil, nil).Bytes(),
+			change: &ChangeEvent{
+				Table: "projects", Operation: "DELETE", TxID: 742, Seq: 5, CommitTime: commitTime,
+				OldRow: map[string]string{"id": "2"},
+			},
+		},
+		{
+			name: "insert outside public",
+			message: newPgoutputMessage('I').uint32(16390).
+				tuple('N', text("7")).Bytes(),
+			change: &ChangeEvent{
+				Table: "audit.projects", Operation: "INSERT", TxID: 742, Seq: 6, CommitTime: commitTime,
+				NewRow: map[string]string{"id": "7"},
+			},
+		},
+		{
+			name:      "commit",
+			message:   newPgoutputMessage('C').byte1(0).uint64(0x16B3748).uint64(0x16B3778).uint64(commitMicros).Bytes(),
+			commitLSN: 0x16B3778,
+		},
+		{
+			name:    "origin",
+			message: newPgoutputMessage('O').uint64(0x16B3748).cstring("upstream").Bytes(),
+		},
+	}
+
+	for _, test := range tests {
+		change, commitLSN, err := decoder.decode(test.message)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(change, test.change) {
+			t.Errorf("%s: got change %+v, want %+v", test.name, change, test.change)
+		}
+		if commitLSN != test.commitLSN {
+			t.Errorf("%s: got commit LSN %X, want %X", test.name, commitLSN, test.commitLSN)
+		}
+	}
+
+	if decoder.inTransaction {
+		t.Errorf("transaction still open after its commit")
+	}
+}
+
+func TestPgoutputDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{
+			name:    "change for unknown relation",
+			message: newPgoutputMessage('I').uint32(99).tuple('N', text("1")).Bytes(),
+		},
+		{
+			name:    "truncated begin",
+			message: newPgoutputMessage('B').uint64(1).Bytes(),
+		},
+		{
+			name:    "truncated relation",
+			message: relationMessage(16384, "public", "projects", "id")[:12],
+		},
+		{
+			name:    "truncated column value",
+			message: dropLast(newPgoutputMessage('I').uint32(16384).tuple('N', text("fold")).Bytes(), 2),
+		},
+		{
+			name:    "unexpected tuple kind",
+			message: newPgoutputMessage('U').uint32(16384).tuple('X', text("1")).Bytes(),
+		},
+	}
+
+	for _, test := range tests {
+		decoder := &pgoutputDecoder{relations: map[uint32]replicationRelation{
+			16384: {Name: "projects", Columns: []string{"id"}},
+		}}
+		_, _, err := decoder.decode(test.message)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"fmt"
@@ -22,8 +23,20 @@ const projects_mapping_index = "projects_index"
 var esClient *elasticsearch.Client
 
 func main() {
-	// Initialize PostgreSQL connection
 	godotenv.Load(".env")
+
+	// Load the pipeline spec that triggers, documents and mappings are generated from
+	pipelineSpecPath := os.Getenv("PIPELINE_SPEC")
+	if pipelineSpecPath == "" {
+		pipelineSpecPath = "pipeline.json"
+	}
+	spec, err := loadPipelineSpec(pipelineSpecPath)
+	if err != nil {
+		log.Fatalf("Error loading pipeline spec: %v", err)
+	}
+	pipeline = spec
+
+	// Initialize PostgreSQL connection
 	pgConnStr := fmt.Sprintf("user=%s dbname=fold-finance sslmode=disable", os.Getenv("POSTGRES_USER"))
 
 	pgDB, err := sql.Open("postgres", pgConnStr)
@@ -38,10 +51,26 @@ func main() {
 		log.Fatalf("Error creating table: %v", err)
 	}
 
-	// Set up triggers for data changes
-	err = createTriggers(pgDB)
+	// Changes are captured by triggers into the outbox unless another source is requested
+	cdcSource := os.Getenv("CDC_SOURCE")
+	source, err := newSource(cdcSource, pgDB, pgConnStr)
 	if err != nil {
-		log.Fatalf("Error creating triggers: %v", err)
+		log.Fatalf("Error configuring change source: %v", err)
+	}
+
+	// Set up triggers for data changes, one event per row unless statement level triggers are requested
+	if _, ok := source.(*outboxSource); ok {
+		triggerMode := os.Getenv("TRIGGER_MODE")
+		if triggerMode == "" {
+			triggerMode = triggerModeRow
+		}
+		err = createTriggers(pgDB, triggerMode)
+		if err != nil {
+			log.Fatalf("Error creating triggers: %v", err)
+		}
+	} else {
+		// Triggers of earlier runs would keep filling the outbox nobody reads
+		removeTriggers(pgDB)
 	}
 
 	// Initialize Elasticsearch client
@@ -67,10 +96,34 @@ func main() {
 	// 	fmt.Println("Elasticsearch ping failed: %v", err)
 	// }
 
-	// Create elasticsearch missing mappings
-	err = createElasticSearchMappings(esClient)
+	esBulkConfig, err = loadBulkWriterConfig()
 	if err != nil {
-		log.Fatalf("Error creating mappings: %v", err)
+		log.Fatalf("Error configuring bulk writes: %v", err)
+	}
+
+	// Documents go to elasticsearch unless the NDJSON file sink is requested
+	sinkKind := os.Getenv("SINK")
+	var sink Sink
+	if sinkKind == "ndjson" {
+		sinkDir := os.Getenv("NDJSON_SINK_DIR")
+		if sinkDir == "" {
+			sinkDir = "sync_output"
+		}
+		sink, err = newNDJSONSink(sinkDir, ndjsonSinkMaxBytes)
+		if err != nil {
+			log.Fatalf("Error creating the NDJSON sink: %v", err)
+		}
+	} else {
+		sink = newElasticsearchSink(esClient, projects_mapping_index)
+	}
+	projectsIndex.sinks = []Sink{sink}
+
+	// Create elasticsearch missing mappings
+	if sinkKind != "ndjson" {
+		err = createElasticSearchMappings(pgDB, esClient)
+		if err != nil {
+			log.Fatalf("Error creating mappings: %v", err)
+		}
 	}
 
 	// // Get all mappings
@@ -83,8 +136,21 @@ func main() {
 	// formattedMappings, _ := json.MarshalIndent(mappings, "", "  ")
 	// fmt.Printf("Mappings:\n%s\n", formattedMappings)
 
+	// Index everything already in postgres before live sync takes over
+	if os.Getenv("BACKFILL") == "true" {
+		err = backfillProjects(pgDB, sink)
+		if err != nil {
+			log.Fatalf("Error backfilling projects: %v", err)
+		}
+	}
+
 	// Start the listener in a separate goroutine
-	go startNotificationListener(pgDB, esClient, pgConnStr)
+	syncConfig, err := loadSyncHandlerConfig()
+	if err != nil {
+		log.Fatalf("Error configuring sync workers: %v", err)
+	}
+	handler := newSyncHandler(pgDB, syncConfig)
+	go superviseSource(context.Background(), source, handler)
 	time.Sleep(1 * time.Second)
 
 	err = seedData(pgDB)
@@ -118,6 +184,37 @@ func main() {
 		fuzzySearchProjects(c, esClient)
 	})
 
+	// Admin endpoint to rebuild the projects index behind its alias
+	router.POST("/admin/reindex", func(c *gin.Context) {
+		startReindex(c, pgDB, esClient)
+	})
+
+	// Admin endpoint showing how far the sync workers are behind
+	router.GET("/admin/sync-status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, handler.queueStatus())
+	})
+
+	// Admin endpoints to inspect and recover change events that failed to sync
+	router.GET("/admin/dead-letters", func(c *gin.Context) {
+		listDeadLettersHandler(c, pgDB)
+	})
+
+	router.GET("/admin/dead-letters/:id", func(c *gin.Context) {
+		getDeadLetterHandler(c, pgDB)
+	})
+
+	router.POST("/admin/dead-letters/retry", func(c *gin.Context) {
+		retryAllDeadLettersHandler(c, handler)
+	})
+
+	router.POST("/admin/dead-letters/:id/retry", func(c *gin.Context) {
+		retryDeadLetterHandler(c, handler)
+	})
+
+	router.DELETE("/admin/dead-letters/:id", func(c *gin.Context) {
+		discardDeadLetterHandler(c, pgDB)
+	})
+
 	// Set up a signal listener to handle server shutdown
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
@@ -130,7 +227,9 @@ func main() {
 		clearTables(pgDB)
 
 		// Clear Elasticsearch indices
-		clearElasticsearchIndices(esClient)
+		if sinkKind != "ndjson" {
+			clearElasticsearchIndices(esClient)
+		}
 
 		os.Exit(0)
 	}()
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Number of outbox events fetched per query
+const outboxBatchSize = 100
+
+// Interval at which the outbox is polled even if no notification arrives
+const outboxPollInterval = 30 * time.Second
+
+// Processed events are kept around this long for debugging before being purged
+const outboxRetention = 24 * time.Hour
+
+type outboxEvent struct {
+	ID    int64
+	Event ChangeEvent
+}
+
+// Source reading row changes recorded by the triggers in the sync outbox. With a
+// connection string the source listens for notifications and polls as a fallback,
+// without one it only polls
+type outboxSource struct {
+	pgDB         *sql.DB
+	pgConnStr    string
+	pollInterval time.Duration
+	// Highest event id that may have been handed to a handler before
+	delivered int64
+}
+
+func newOutboxSource(pgDB *sql.DB, pgConnStr string) *outboxSource {
+	return &outboxSource{pgDB: pgDB, pgConnStr: pgConnStr, pollInterval: outboxPollInterval}
+}
+
+func (s *outboxSource) Run(ctx context.Context, handler ChangeHandler) error {
+	var notify <-chan *pq.Notification
+	if s.pgConnStr != "" {
+		// Set up PostgreSQL listener
+		listener := pq.NewListener(s.pgConnStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Listener error: %v", err)
+			}
+		})
+		defer listener.Close()
+
+		// Add PostgreSQL notifications to listener
+		err := listener.Listen("data_changes")
+		if err != nil {
+			return fmt.Errorf("error setting up LISTEN channel: %v", err)
+		}
+		notify = listener.Notify
+	}
+
+	// Events recorded before this run may have been delivered already
+	err := s.pgDB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM sync_outbox").Scan(&s.delivered)
+	if err != nil {
+		return err
+	}
+
+	// Catch up on events committed while the service was down
+	err = s.processOutbox(handler)
+	if err != nil {
+		log.Printf("Error processing sync outbox: %v", err)
+	}
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	// Notifications only wake the worker, the outbox is the source of truth.
+	// Polling covers notifications lost while the listener was reconnecting
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-notify:
+			if !ok {
+				return fmt.Errorf("notification listener closed")
+			}
+		case <-ticker.C:
+			purgeProcessedOutboxEvents(s.pgDB)
+		}
+
+		err := s.processOutbox(handler)
+		if err != nil {
+			log.Printf("Error processing sync outbox: %v", err)
+		}
+	}
+}
+
+// Function to hand pending outbox events to the handler in order until the outbox is drained.
+// Stops at the first failure so the events are retried, in order, on the next run
+func (s *outboxSource) processOutbox(handler ChangeHandler) error {
+	for {
+		events, err := fetchPendingOutboxEvents(s.pgDB, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		// The batch holds complete transactions, a failure leaves all of it for the next run
+		var handled []int64
+		for _, event := range events {
+			event.Event.live = event.ID > s.delivered
+			if event.ID > s.delivered {
+				s.delivered = event.ID
+			}
+			err = handler.Handle(event.Event)
+			if err != nil {
+				handler.Discard(event.Event.TxID)
+				return err
+			}
+			handled = append(handled, event.ID)
+		}
+
+		// Events are only marked processed once their writes are flushed
+		err = handler.Flush()
+		if err != nil {
+			return err
+		}
+
+		err = markOutboxEventsProcessed(s.pgDB, handled)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Function to fetch the unprocessed outbox events of the oldest transactions. The limit picks
+// the transactions, each of them is fetched completely so it is never split between batches.
+// Rows written before transaction ids were recorded count as transactions of their own
+func fetchPendingOutboxEvents(pgDB *sql.DB, limit int) ([]outboxEvent, error) {
+	rows, err := pgDB.Query(`
+		SELECT id, table_name, operation, old_row, new_row, project_ids, changed_fields, COALESCE(txid, -id), COALESCE(tx_seq, 1)
+		FROM sync_outbox
+		WHERE processed_at IS NULL AND COALESCE(txid, -id) IN (
+			SELECT COALESCE(txid, -id)
+			FROM sync_outbox
+			WHERE processed_at IS NULL
+			ORDER BY id
+			LIMIT $1
+		)
+		ORDER BY MIN(id) OVER (PARTITION BY COALESCE(txid, -id)), tx_seq, id`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []outboxEvent
+	for rows.Next() {
+		var event outboxEvent
+		var oldRow, newRow []byte
+		var projectIDs []int64
+		err := rows.Scan(&event.ID, &event.Event.Table, &event.Event.Operation, &oldRow, &newRow, pq.Array(&projectIDs), pq.Array(&event.Event.ChangedFields), &event.Event.TxID, &event.Event.Seq)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Event.OldRow, err = outboxRow(oldRow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid old row in outbox event %d: %v", event.ID, err)
+		}
+		event.Event.NewRow, err = outboxRow(newRow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid new row in outbox event %d: %v", event.ID, err)
+		}
+		for _, projectID := range projectIDs {
+			event.Event.ProjectIDs = append(event.Event.ProjectIDs, int(projectID))
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// Function to convert a row stored as jsonb back to text values, leaving out NULL columns
+func outboxRow(data []byte) (map[string]string, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	row := map[string]string{}
+	for column, value := range values {
+		switch value := value.(type) {
+		case nil:
+			continue
+		case string:
+			row[column] = value
+		case json.Number:
+			row[column] = value.String()
+		case bool:
+			row[column] = strconv.FormatBool(value)
+		default:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			row[column] = string(encoded)
+		}
+	}
+	return row, nil
+}
+
+func markOutboxEventsProcessed(pgDB *sql.DB, ids []int64) error {
+	_, err := pgDB.Exec("UPDATE sync_outbox SET processed_at = NOW() WHERE id = ANY($1)", pq.Array(ids))
+	return err
+}
+
+func purgeProcessedOutboxEvents(pgDB *sql.DB) {
+	_, err := pgDB.Exec("DELETE FROM sync_outbox WHERE processed_at < $1", time.Now().Add(-outboxRetention))
+	if err != nil {
+		log.Printf("Error purging processed outbox events: %v", err)
+	}
+}
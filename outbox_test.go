@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutboxRow(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		row  map[string]string
+	}{
+		{
+			name: "missing row",
+		},
+		{
+			name: "scalar values",
+			data: []byte(`{"id": 12345678901, "name": "fold", "budget": 12.50, "archived": false}`),
+			row:  map[string]string{"id": "12345678901", "name": "fold", "budget": "12.50", "archived": "false"},
+		},
+		{
+			// Absent columns read as NULL, the same as in logical replication events
+			name: "null column",
+			data: []byte(`{"id": 1, "name": null}`),
+			row:  map[string]string{"id": "1"},
+		},
+		{
+			name: "json column",
+			data: []byte(`{"id": 1, "settings": {"public": true}, "tags": ["a", "b"]}`),
+			row:  map[string]string{"id": "1", "settings": `{"public":true}`, "tags": `["a","b"]`},
+		},
+	}
+
+	for _, test := range tests {
+		row, err := outboxRow(test.data)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(row, test.row) {
+			t.Errorf("%s: got row %v, want %v", test.name, row, test.row)
+		}
+	}
+
+	if _, err := outboxRow([]byte(`{"id": `)); err == nil {
+		t.Errorf("expected an error for a truncated row")
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Ways a child table can be denormalized into the root document
+const (
+	// Array of objects built from the child rows linked through a join table
+	denormalizeNested = "nested"
+	// Array with one column of the child rows linked through a join table
+	denormalizeKeywordArray = "keyword_array"
+	// Single column of the child row referenced by a column of the root table
+	denormalizeScalar = "scalar"
+)
+
+// Pipeline loaded from the spec file on startup. Triggers, the document query,
+// the replication fan-out and the index mapping are all generated from it
+var pipeline *pipelineSpec
+
+type pipelineSpec struct {
+	Root     pipelineRoot    `json:"root"`
+	Children []pipelineChild `json:"children"`
+}
+
+type pipelineField struct {
+	Name string `json:"name"`
+	// Elasticsearch field type
+	Type string `json:"type"`
+}
+
+type pipelineRoot struct {
+	Table      string          `json:"table"`
+	PrimaryKey string          `json:"primary_key"`
+	Fields     []pipelineField `json:"fields"`
+}
+
+type pipelineChild struct {
+	// Field of the root document the child is stored in
+	Name        string `json:"name"`
+	Table       string `json:"table"`
+	PrimaryKey  string `json:"primary_key"`
+	Denormalize string `json:"denormalize"`
+
+	// Join table linking root and child rows, for nested and keyword_array children
+	JoinTable    string `json:"join_table"`
+	JoinRootKey  string `json:"join_root_key"`
+	JoinChildKey string `json:"join_child_key"`
+
+	// Column of the root table referencing the child, for scalar children
+	RootKey string `json:"root_key"`
+
+	// Copied column, for keyword_array and scalar children
+	Column string `json:"column"`
+	// Elasticsearch type of the copied column, for scalar children
+	Type string `json:"type"`
+
+	// Copied columns, for nested children
+	Fields []pipelineField `json:"fields"`
+}
+
+// Role a postgres table plays in the pipeline, used to find the documents a row change affects
+type pipelineTableRole struct {
+	Kind  string // root, join, child
+	Child *pipelineChild
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// Function to read and validate a pipeline spec file
+func loadPipelineSpec(path string) (*pipelineSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec pipelineSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid pipeline spec %s: %v", path, err)
+	}
+
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("invalid pipeline spec %s: %v", path, err)
+	}
+	return &spec, nil
+}
+
+func (spec *pipelineSpec) validate() error {
+	// Names end up in generated SQL, so only plain identifiers are accepted
+	checkIdentifiers := func(context string, names ...string) error {
+		for _, name := range names {
+			if !sqlIdentifier.MatchString(name) {
+				return fmt.Errorf("%s: %q is not a valid identifier", context, name)
+			}
+		}
+		return nil
+	}
+	checkFields := func(context string, fields []pipelineField) error {
+		if len(fields) == 0 {
+			return fmt.Errorf("%s: no fields", context)
+		}
+		for _, field := range fields {
+			if err := checkIdentifiers(context, field.Name); err != nil {
+				return err
+			}
+			if field.Type == "" {
+				return fmt.Errorf("%s: field %s has no type", context, field.Name)
+			}
+		}
+		return nil
+	}
+
+	if err := checkIdentifiers("root", spec.Root.Table, spec.Root.PrimaryKey); err != nil {
+		return err
+	}
+	if err := checkFields("root", spec.Root.Fields); err != nil {
+		return err
+	}
+
+	// The version field is added to every document by the writers
+	names := map[string]bool{syncVersionField: true}
+	for _, field := range spec.Root.Fields {
+		if names[field.Name] {
+			return fmt.Errorf("root: field name %s is already used", field.Name)
+		}
+		names[field.Name] = true
+	}
+
+	for _, child := range spec.Children {
+		context := "child " + child.Name
+		if err := checkIdentifiers(context, child.Name, child.Table, child.PrimaryKey); err != nil {
+			return err
+		}
+		if names[child.Name] {
+			return fmt.Errorf("%s: field name is already used", context)
+		}
+		names[child.Name] = true
+
+		switch child.Denormalize {
+		case denormalizeNested:
+			if err := checkIdentifiers(context, child.JoinTable, child.JoinRootKey, child.JoinChildKey); err != nil {
+				return err
+			}
+			if err := checkFields(context, child.Fields); err != nil {
+				return err
+			}
+		case denormalizeKeywordArray:
+			if err := checkIdentifiers(context, child.JoinTable, child.JoinRootKey, child.JoinChildKey, child.Column); err != nil {
+				return err
+			}
+		case denormalizeScalar:
+			if err := checkIdentifiers(context, child.RootKey, child.Column); err != nil {
+				return err
+			}
+			if child.Type == "" {
+				return fmt.Errorf("%s: scalar children need a type", context)
+			}
+		default:
+			return fmt.Errorf("%s: unknown denormalization %q", context, child.Denormalize)
+		}
+	}
+	return nil
+}
+
+// Function to list every table whose changes affect the documents, in spec order
+func (spec *pipelineSpec) tables() []string {
+	var tables []string
+	seen := map[string]bool{}
+	add := func(table string) {
+		if table != "" && !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+
+	add(spec.Root.Table)
+	for _, child := range spec.Children {
+		add(child.JoinTable)
+		add(child.Table)
+	}
+	return tables
+}
+
+// Function to list the roles a table plays, a table can be used by several children
+func (spec *pipelineSpec) tableRoles(table string) []pipelineTableRole {
+	var roles []pipelineTableRole
+	if table == spec.Root.Table {
+		roles = append(roles, pipelineTableRole{Kind: "root"})
+	}
+	for i := range spec.Children {
+		child := &spec.Children[i]
+		if child.JoinTable == table {
+			roles = append(roles, pipelineTableRole{Kind: "join", Child: child})
+		}
+		if child.Table == table {
+			roles = append(roles, pipelineTableRole{Kind: "child", Child: child})
+		}
+	}
+	return roles
+}
+
+// Function to generate the elasticsearch index body of the documents
+func (spec *pipelineSpec) mapping() map[string]interface{} {
+	fieldProperties := func(fields []pipelineField) map[string]interface{} {
+		properties := map[string]interface{}{}
+		for _, field := range fields {
+			properties[field.Name] = map[string]interface{}{"type": field.Type}
+		}
+		return properties
+	}
+
+	properties := fieldProperties(spec.Root.Fields)
+	properties[syncVersionField] = map[string]interface{}{"type": "long"}
+	for _, child := range spec.Children {
+		switch child.Denormalize {
+		case denormalizeNested:
+			properties[child.Name] = map[string]interface{}{
+				"type":       "nested",
+				"properties": fieldProperties(child.Fields),
+			}
+		case denormalizeKeywordArray:
+			properties[child.Name] = map[string]interface{}{"type": "keyword"}
+		case denormalizeScalar:
+			properties[child.Name] = map[string]interface{}{"type": child.Type}
+		}
+	}
+
+	return map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"properties": properties,
+		},
+	}
+}
+
+// Function to generate the SQL expression building the document of root row p
+func (spec *pipelineSpec) documentExpression() string {
+	var arguments []string
+	for _, field := range spec.Root.Fields {
+		arguments = append(arguments, fmt.Sprintf("'%s', p.%s", field.Name, field.Name))
+	}
+
+	for _, child := range spec.Children {
+		var value string
+		switch child.Denormalize {
+		case denormalizeNested:
+			var fields []string
+			for _, field := range child.Fields {
+				fields = append(fields, fmt.Sprintf("'%s', c.%s", field.Name, field.Name))
+			}
+			// Each linked child appears once, matched by its key, even if the join table links it twice
+			value = fmt.Sprintf(`COALESCE((
+			SELECT json_agg(json_build_object(%s) ORDER BY c.%s)
+			FROM %s c
+			WHERE c.%s IN (SELECT j.%s FROM %s j WHERE j.%s = p.%s)
+		), '[]'::json)`, strings.Join(fields, ", "), child.PrimaryKey, child.Table,
+				child.PrimaryKey, child.JoinChildKey, child.JoinTable, child.JoinRootKey, spec.Root.PrimaryKey)
+		case denormalizeKeywordArray:
+			// The values form a set, children sharing a value add it once
+			value = fmt.Sprintf(`COALESCE((
+			SELECT json_agg(DISTINCT c.%s ORDER BY c.%s) FILTER (WHERE c.%s IS NOT NULL)
+			FROM %s c
+			WHERE c.%s IN (SELECT j.%s FROM %s j WHERE j.%s = p.%s)
+		), '[]'::json)`, child.Column, child.Column, child.Column, child.Table,
+				child.PrimaryKey, child.JoinChildKey, child.JoinTable, child.JoinRootKey, spec.Root.PrimaryKey)
+		case denormalizeScalar:
+			value = fmt.Sprintf("(SELECT c.%s FROM %s c WHERE c.%s = p.%s)",
+				child.Column, child.Table, child.PrimaryKey, child.RootKey)
+		}
+		arguments = append(arguments, fmt.Sprintf("'%s', %s", child.Name, value))
+	}
+
+	return "json_build_object(\n\t\t" + strings.Join(arguments, ",\n\t\t") + "\n\t)"
+}
+
+// Function to list the root table columns a document is built from
+func (spec *pipelineSpec) indexedRootColumns() []string {
+	seen := map[string]bool{}
+	var columns []string
+	addColumn := func(column string) {
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+
+	addColumn(spec.Root.PrimaryKey)
+	for _, field := range spec.Root.Fields {
+		addColumn(field.Name)
+	}
+	for _, child := range spec.Children {
+		if child.Denormalize == denormalizeScalar {
+			addColumn(child.RootKey)
+		}
+	}
+	return columns
+}
+
+// Function to list the child columns copied into the documents
+func (child *pipelineChild) copiedColumns() []string {
+	if child.Denormalize != denormalizeNested {
+		return []string{child.Column}
+	}
+	var columns []string
+	for _, field := range child.Fields {
+		columns = append(columns, field.Name)
+	}
+	return columns
+}
+
+// Function to generate the trigger function of a table. It records the row change through
+// record_row_change if the change can affect a root document, the consumer resolves which ones.
+// Updates of the root table only record the key and the indexed columns that changed
+func (spec *pipelineSpec) triggerStatement(table string) string {
+	roles := spec.tableRoles(table)
+
+	var conditions []string
+	for _, role := range roles {
+		switch role.Kind {
+		case "root":
+			// Updates of columns that aren't indexed don't change the document
+			columns := spec.indexedRootColumns()
+			newColumns := "ROW(NEW." + strings.Join(columns, ", NEW.") + ")"
+			oldColumns := "ROW(OLD." + strings.Join(columns, ", OLD.") + ")"
+			conditions = append(conditions, fmt.Sprintf("TG_OP <> 'UPDATE' OR %s IS DISTINCT FROM %s", newColumns, oldColumns))
+		case "join":
+			conditions = append(conditions, "TG_OP <> 'UPDATE' OR NEW IS DISTINCT FROM OLD")
+		case "child":
+			// Inserted child rows aren't linked yet, updates only matter if a copied column changed
+			columns := role.Child.copiedColumns()
+			newColumns := "ROW(NEW." + strings.Join(columns, ", NEW.") + ")"
+			oldColumns := "ROW(OLD." + strings.Join(columns, ", OLD.") + ")"
+			conditions = append(conditions, fmt.Sprintf("TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND %s IS DISTINCT FROM %s)", newColumns, oldColumns))
+		}
+	}
+
+	record := "PERFORM record_row_change(TG_TABLE_NAME, TG_OP, to_jsonb(OLD), to_jsonb(NEW), NULL);"
+	if len(roles) == 1 && roles[0].Kind == "root" {
+		var changes []string
+		for _, column := range spec.indexedRootColumns() {
+			changes = append(changes, fmt.Sprintf("CASE WHEN NEW.%s IS DISTINCT FROM OLD.%s THEN '%s' END", column, column, column))
+		}
+		key := spec.Root.PrimaryKey
+		record = fmt.Sprintf(`IF TG_OP = 'UPDATE' THEN
+							changed := array_remove(ARRAY[%s], NULL);
+							PERFORM record_row_change(TG_TABLE_NAME, TG_OP, jsonb_build_object('%s', OLD.%s),
+								(SELECT jsonb_object_agg(key, value) FROM jsonb_each(to_jsonb(NEW)) WHERE key = ANY(changed || '%s'::TEXT)), changed);
+						ELSE
+							%s
+						END IF;`, strings.Join(changes, ", "), key, key, key, record)
+	}
+
+	return fmt.Sprintf(`
+				CREATE OR REPLACE FUNCTION %s_data_changes()
+				RETURNS TRIGGER AS $$
+				DECLARE
+					changed TEXT[];
+				BEGIN
+					IF (%s) THEN
+						%s
+					END IF;
+					RETURN NEW;
+				END;
+				$$ LANGUAGE plpgsql;
+			`, table, strings.Join(conditions, ") OR ("), record)
+}
+
+// Function to generate the statement level trigger function of a table. It reads the rows of
+// the statement from the transition tables new_rows and old_rows and records one event listing
+// every root document the statement can affect through record_statement_change
+func (spec *pipelineSpec) statementTriggerStatement(table string) string {
+	var inserted, updated, deleted []string
+	for _, role := range spec.tableRoles(table) {
+		switch role.Kind {
+		case "root", "join":
+			column := spec.Root.PrimaryKey
+			compared := strings.Join(spec.indexedRootColumns(), ", ")
+			if role.Kind == "join" {
+				column = role.Child.JoinRootKey
+				compared = "*"
+			}
+			inserted = append(inserted, fmt.Sprintf("SELECT n.%s FROM new_rows n", column))
+			deleted = append(deleted, fmt.Sprintf("SELECT o.%s FROM old_rows o", column))
+			// Rows the statement left unchanged don't count, a changed key affects both documents
+			updated = append(updated,
+				fmt.Sprintf("SELECT n.%s FROM (SELECT %s FROM new_rows EXCEPT SELECT %s FROM old_rows) n", column, compared, compared),
+				fmt.Sprintf("SELECT o.%s FROM (SELECT %s FROM old_rows EXCEPT SELECT %s FROM new_rows) o", column, compared, compared))
+		case "child":
+			// Same rules as the row trigger, inserts are skipped and updates compare the copied columns
+			child := role.Child
+			columns := child.copiedColumns()
+			changed := fmt.Sprintf("(SELECT o.* FROM old_rows o JOIN new_rows n ON n.%s = o.%s WHERE ROW(n.%s) IS DISTINCT FROM ROW(o.%s))",
+				child.PrimaryKey, child.PrimaryKey, strings.Join(columns, ", n."), strings.Join(columns, ", o."))
+			updated = append(updated, spec.linkedRootsFromQuery(child, changed))
+			deleted = append(deleted, spec.linkedRootsFromQuery(child, "old_rows"))
+		}
+	}
+
+	collect := func(queries []string) string {
+		if len(queries) == 0 {
+			return "project_ids := NULL;"
+		}
+		return fmt.Sprintf("SELECT array_agg(DISTINCT id ORDER BY id) INTO project_ids FROM (%s) affected(id);",
+			strings.Join(queries, " UNION "))
+	}
+
+	return fmt.Sprintf(`
+				CREATE OR REPLACE FUNCTION %s_statement_changes()
+				RETURNS TRIGGER AS $$
+				DECLARE
+					project_ids INTEGER[];
+				BEGIN
+					IF TG_OP = 'INSERT' THEN
+						%s
+					ELSIF TG_OP = 'UPDATE' THEN
+						%s
+					ELSE
+						%s
+					END IF;
+					IF project_ids IS NOT NULL THEN
+						PERFORM record_statement_change(TG_TABLE_NAME, TG_OP, project_ids);
+					END IF;
+					RETURN NULL;
+				END;
+				$$ LANGUAGE plpgsql;
+			`, table, collect(inserted), collect(updated), collect(deleted))
+}
+
+// Function to generate the query listing the root documents a child row is copied into
+func (spec *pipelineSpec) linkedRootsQuery(child *pipelineChild, childID string) string {
+	if child.Denormalize == denormalizeScalar {
+		return fmt.Sprintf("SELECT r.%s FROM %s r WHERE r.%s = %s", spec.Root.PrimaryKey, spec.Root.Table, child.RootKey, childID)
+	}
+	return fmt.Sprintf("SELECT j.%s FROM %s j WHERE j.%s = %s", child.JoinRootKey, child.JoinTable, child.JoinChildKey, childID)
+}
+
+// Function to generate the query listing the root documents the child rows of a FROM item are copied into
+func (spec *pipelineSpec) linkedRootsFromQuery(child *pipelineChild, childRows string) string {
+	if child.Denormalize == denormalizeScalar {
+		return fmt.Sprintf("SELECT r.%s FROM %s r JOIN %s c ON r.%s = c.%s",
+			spec.Root.PrimaryKey, spec.Root.Table, childRows, child.RootKey, child.PrimaryKey)
+	}
+	return fmt.Sprintf("SELECT j.%s FROM %s j JOIN %s c ON j.%s = c.%s",
+		child.JoinRootKey, child.JoinTable, childRows, child.JoinChildKey, child.PrimaryKey)
+}
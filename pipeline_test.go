@@ -0,0 +1,267 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Spec using every kind of child, users are copied both as nested objects and as the scalar owner
+func newTestPipelineSpec() *pipelineSpec {
+	return &pipelineSpec{
+		Root: pipelineRoot{
+			Table:      "projects",
+			PrimaryKey: "id",
+			Fields: []pipelineField{
+				{Name: "id", Type: "integer"},
+				{Name: "name", Type: "text"},
+				{Name: "budget", Type: "long"},
+			},
+		},
+		Children: []pipelineChild{
+			{
+				Name: "users", Table: "users", PrimaryKey: "id", Denormalize: denormalizeNested,
+				JoinTable: "users_projects", JoinRootKey: "project_id", JoinChildKey: "user_id",
+				Fields: []pipelineField{{Name: "id", Type: "integer"}, {Name: "name", Type: "text"}},
+			},
+			{
+				Name: "hashtags", Table: "hashtags", PrimaryKey: "id", Denormalize: denormalizeKeywordArray,
+				JoinTable: "project_hashtags", JoinRootKey: "project_id", JoinChildKey: "hashtag_id",
+				Column: "name",
+			},
+			{
+				Name: "owner", Table: "users", PrimaryKey: "id", Denormalize: denormalizeScalar,
+				RootKey: "owner_id", Column: "name", Type: "keyword",
+			},
+		},
+	}
+}
+
+// Function to collapse the whitespace of generated SQL, so tests don't depend on its indentation
+func normalizeSQL(sql string) string {
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+func checkSQL(t *testing.T, name string, sql string, contains []string, excludes []string) {
+	t.Helper()
+	sql = normalizeSQL(sql)
+	for _, part := range contains {
+		if !strings.Contains(sql, normalizeSQL(part)) {
+			t.Errorf("%s: missing %q in\n%s", name, part, sql)
+		}
+	}
+	for _, part := range excludes {
+		if strings.Contains(sql, normalizeSQL(part)) {
+			t.Errorf("%s: unexpected %q in\n%s", name, part, sql)
+		}
+	}
+}
+
+func TestPipelineSpecValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(spec *pipelineSpec)
+		err    string
+	}{
+		{
+			name:   "valid",
+			modify: func(spec *pipelineSpec) {},
+		},
+		{
+			name:   "invalid table name",
+			modify: func(spec *pipelineSpec) { spec.Root.Table = "projects; DROP TABLE users" },
+			err:    "root: \"projects; DROP TABLE users\" is not a valid identifier",
+		},
+		{
+			name:   "root without fields",
+			modify: func(spec *pipelineSpec) { spec.Root.Fields = nil },
+			err:    "root: no fields",
+		},
+		{
+			name:   "field without type",
+			modify: func(spec *pipelineSpec) { spec.Root.Fields[1].Type = "" },
+			err:    "root: field name has no type",
+		},
+		{
+			name:   "duplicate root field",
+			modify: func(spec *pipelineSpec) { spec.Root.Fields[2].Name = "name" },
+			err:    "root: field name name is already used",
+		},
+		{
+			name:   "reserved version field",
+			modify: func(spec *pipelineSpec) { spec.Root.Fields[2].Name = syncVersionField },
+			err:    "root: field name sync_version is already used",
+		},
+		{
+			name:   "child named like a root field",
+			modify: func(spec *pipelineSpec) { spec.Children[1].Name = "budget" },
+			err:    "child budget: field name is already used",
+		},
+		{
+			name:   "nested child without fields",
+			modify: func(spec *pipelineSpec) { spec.Children[0].Fields = nil },
+			err:    "child users: no fields",
+		},
+		{
+			name:   "keyword array without join table",
+			modify: func(spec *pipelineSpec) { spec.Children[1].JoinTable = "" },
+			err:    "child hashtags: \"\" is not a valid identifier",
+		},
+		{
+			name:   "scalar child without type",
+			modify: func(spec *pipelineSpec) { spec.Children[2].Type = "" },
+			err:    "child owner: scalar children need a type",
+		},
+		{
+			name:   "unknown denormalization",
+			modify: func(spec *pipelineSpec) { spec.Children[2].Denormalize = "flattened" },
+			err:    "child owner: unknown denormalization \"flattened\"",
+		},
+	}
+
+	for _, test := range tests {
+		spec := newTestPipelineSpec()
+		test.modify(spec)
+		err := spec.validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCopiedColumns(t *testing.T) {
+	spec := newTestPipelineSpec()
+	tests := []struct {
+		child   int
+		columns []string
+	}{
+		{child: 0, columns: []string{"id", "name"}},
+		{child: 1, columns: []string{"name"}},
+		{child: 2, columns: []string{"name"}},
+	}
+
+	for _, test := range tests {
+		child := &spec.Children[test.child]
+		if columns := child.copiedColumns(); !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("%s: got columns %v, want %v", child.Name, columns, test.columns)
+		}
+	}
+}
+
+func TestTriggerStatement(t *testing.T) {
+	tests := []struct {
+		table    string
+		contains []string
+		excludes []string
+	}{
+		{
+			table: "projects",
+			contains: []string{
+				"CREATE OR REPLACE FUNCTION projects_data_changes()",
+				// The key is listed once, the scalar child reference is indexed as well
+				"IF (TG_OP <> 'UPDATE' OR ROW(NEW.id, NEW.name, NEW.budget, NEW.owner_id) IS DISTINCT FROM ROW(OLD.id, OLD.name, OLD.budget, OLD.owner_id)) THEN",
+				"CASE WHEN NEW.owner_id IS DISTINCT FROM OLD.owner_id THEN 'owner_id' END",
+				"PERFORM record_row_change(TG_TABLE_NAME, TG_OP, jsonb_build_object('id', OLD.id),",
+				"WHERE key = ANY(changed || 'id'::TEXT)), changed);",
+				"PERFORM record_row_change(TG_TABLE_NAME, TG_OP, to_jsonb(OLD), to_jsonb(NEW), NULL);",
+			},
+		},
+		{
+			table: "users_projects",
+			contains: []string{
+				"IF (TG_OP <> 'UPDATE' OR NEW IS DISTINCT FROM OLD) THEN",
+				"PERFORM record_row_change(TG_TABLE_NAME, TG_OP, to_jsonb(OLD), to_jsonb(NEW), NULL);",
+			},
+			excludes: []string{"changed :="},
+		},
+		{
+			// Copied into the nested users and the scalar owner, either role's columns count
+			table: "users",
+			contains: []string{
+				"IF (TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND ROW(NEW.id, NEW.name) IS DISTINCT FROM ROW(OLD.id, OLD.name))) OR (TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND ROW(NEW.name) IS DISTINCT FROM ROW(OLD.name))) THEN",
+			},
+			excludes: []string{"changed :="},
+		},
+		{
+			table: "hashtags",
+			contains: []string{
+				"IF (TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND ROW(NEW.name) IS DISTINCT FROM ROW(OLD.name))) THEN",
+			},
+		},
+	}
+
+	spec := newTestPipelineSpec()
+	for _, test := range tests {
+		checkSQL(t, test.table, spec.triggerStatement(test.table), test.contains, test.excludes)
+	}
+}
+
+func TestStatementTriggerStatement(t *testing.T) {
+	tests := []struct {
+		table    string
+		contains []string
+		excludes []string
+	}{
+		{
+			table: "projects",
+			contains: []string{
+				"CREATE OR REPLACE FUNCTION projects_statement_changes()",
+				"IF TG_OP = 'INSERT' THEN SELECT array_agg(DISTINCT id ORDER BY id) INTO project_ids FROM (SELECT n.id FROM new_rows n) affected(id);",
+				// Unchanged rows drop out, a changed key reports the old and the new project
+				"(SELECT n.id FROM (SELECT id, name, budget, owner_id FROM new_rows EXCEPT SELECT id, name, budget, owner_id FROM old_rows) n UNION SELECT o.id FROM (SELECT id, name, budget, owner_id FROM old_rows EXCEPT SELECT id, name, budget, owner_id FROM new_rows) o)",
+				"ELSE SELECT array_agg(DISTINCT id ORDER BY id) INTO project_ids FROM (SELECT o.id FROM old_rows o) affected(id);",
+				"PERFORM record_statement_change(TG_TABLE_NAME, TG_OP, project_ids);",
+			},
+		},
+		{
+			table: "project_hashtags",
+			contains: []string{
+				"(SELECT n.project_id FROM new_rows n)",
+				"(SELECT n.project_id FROM (SELECT * FROM new_rows EXCEPT SELECT * FROM old_rows) n UNION SELECT o.project_id FROM (SELECT * FROM old_rows EXCEPT SELECT * FROM new_rows) o)",
+				"(SELECT o.project_id FROM old_rows o)",
+			},
+		},
+		{
+			table: "users",
+			contains: []string{
+				// Inserted child rows aren't linked to any project yet
+				"IF TG_OP = 'INSERT' THEN project_ids := NULL;",
+				"SELECT j.project_id FROM users_projects j JOIN (SELECT o.* FROM old_rows o JOIN new_rows n ON n.id = o.id WHERE ROW(n.id, n.name) IS DISTINCT FROM ROW(o.id, o.name)) c ON j.user_id = c.id",
+				"SELECT r.id FROM projects r JOIN (SELECT o.* FROM old_rows o JOIN new_rows n ON n.id = o.id WHERE ROW(n.name) IS DISTINCT FROM ROW(o.name)) c ON r.owner_id = c.id",
+				"SELECT j.project_id FROM users_projects j JOIN old_rows c ON j.user_id = c.id UNION SELECT r.id FROM projects r JOIN old_rows c ON r.owner_id = c.id",
+			},
+			excludes: []string{"FROM new_rows n) affected(id)"},
+		},
+	}
+
+	spec := newTestPipelineSpec()
+	for _, test := range tests {
+		checkSQL(t, test.table, spec.statementTriggerStatement(test.table), test.contains, test.excludes)
+	}
+}
+
+func TestDocumentExpression(t *testing.T) {
+	spec := newTestPipelineSpec()
+	checkSQL(t, "document", spec.documentExpression(), []string{
+		"json_build_object( 'id', p.id, 'name', p.name, 'budget', p.budget,",
+		// Nested children are matched by key, a child linked twice appears once
+		`'users', COALESCE((
+			SELECT json_agg(json_build_object('id', c.id, 'name', c.name) ORDER BY c.id)
+			FROM users c
+			WHERE c.id IN (SELECT j.user_id FROM users_projects j WHERE j.project_id = p.id)
+		), '[]'::json)`,
+		// Keyword arrays are sets without nulls
+		`'hashtags', COALESCE((
+			SELECT json_agg(DISTINCT c.name ORDER BY c.name) FILTER (WHERE c.name IS NOT NULL)
+			FROM hashtags c
+			WHERE c.id IN (SELECT j.hashtag_id FROM project_hashtags j WHERE j.project_id = p.id)
+		), '[]'::json)`,
+		"'owner', (SELECT c.name FROM users c WHERE c.id = p.owner_id)",
+	}, nil)
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-	"time"
+	"strings"
+)
 
-	elasticsearch "github.com/elastic/go-elasticsearch/v8"
-	"github.com/lib/pq"
+// Level the triggers record changes at, selected by TRIGGER_MODE
+const (
+	// One event per changed row with both row images
+	triggerModeRow = "row"
+	// One event per statement listing the affected projects, read from transition tables
+	triggerModeStatement = "statement"
 )
 
 // Function to create missing postgres tables
@@ -51,6 +55,55 @@ func createPostgresTables(pgDB *sql.DB) error {
 			PRIMARY KEY (hashtag_id, project_id)
 		);
 		`,
+		`
+		CREATE TABLE IF NOT EXISTS sync_outbox (
+			id BIGSERIAL PRIMARY KEY,
+			table_name VARCHAR NOT NULL,
+			operation VARCHAR NOT NULL,
+			txid BIGINT,
+			tx_seq INTEGER,
+			old_row JSONB,
+			new_row JSONB,
+			project_ids INTEGER[],
+			changed_fields TEXT[],
+			created_at TIMESTAMP DEFAULT NOW(),
+			processed_at TIMESTAMP
+		);
+		`,
+		`
+		ALTER TABLE sync_outbox
+			ADD COLUMN IF NOT EXISTS txid BIGINT,
+			ADD COLUMN IF NOT EXISTS tx_seq INTEGER,
+			ADD COLUMN IF NOT EXISTS old_row JSONB,
+			ADD COLUMN IF NOT EXISTS new_row JSONB,
+			ADD COLUMN IF NOT EXISTS project_ids INTEGER[],
+			ADD COLUMN IF NOT EXISTS changed_fields TEXT[];
+		`,
+		// Events of the first outbox format only hold the affected project. Pending ones are
+		// kept as events listing that project before the column is dropped
+		`
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'sync_outbox' AND column_name = 'project_id') THEN
+				UPDATE sync_outbox SET project_ids = ARRAY[project_id]
+				WHERE processed_at IS NULL AND old_row IS NULL AND new_row IS NULL AND project_ids IS NULL;
+				ALTER TABLE sync_outbox DROP COLUMN project_id;
+			END IF;
+		END $$;
+		`,
+		`
+		CREATE INDEX IF NOT EXISTS sync_outbox_pending_idx ON sync_outbox (id) WHERE processed_at IS NULL;
+		`,
+		`
+		CREATE TABLE IF NOT EXISTS sync_dead_letters (
+			id BIGSERIAL PRIMARY KEY,
+			payload JSONB NOT NULL,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 1,
+			created_at TIMESTAMP DEFAULT NOW(),
+			last_attempt_at TIMESTAMP DEFAULT NOW()
+		);
+		`,
 	}
 
 	for _, statement := range createTablesStatements {
@@ -62,151 +115,151 @@ func createPostgresTables(pgDB *sql.DB) error {
 	return nil
 }
 
-func createTriggers(pgDB *sql.DB) error {
-	triggersToCreate := []struct {
-		Name      string
-		Statement string
-	}{
-		{
-			Name: "projects_data_changes",
-			Statement: `
-				CREATE OR REPLACE FUNCTION projects_data_changes()
-				RETURNS TRIGGER AS $$
-				BEGIN
-					PERFORM pg_notify('data_changes', json_build_object(
-						'trigger_name', 'projects_data_changes',
-						'table_name', TG_TABLE_NAME,
-						'entry', row_to_json(NEW)
-					)::text);
-					RETURN NEW;
-				END;
-				$$ LANGUAGE plpgsql;
-			`,
-		},
-		{
-			Name: "project_hashtags_data_changes",
-			Statement: `
-				CREATE OR REPLACE FUNCTION project_hashtags_data_changes()
-				RETURNS TRIGGER AS $$
-				DECLARE
-					hashtag_name TEXT;
-				BEGIN
-					SELECT h.name INTO hashtag_name FROM hashtags h WHERE h.id = NEW.hashtag_id;
-					PERFORM pg_notify('data_changes', json_build_object(
-						'trigger_name', 'project_hashtags_data_changes',
-						'table_name', TG_TABLE_NAME,
-						'entry', json_build_object(
-							'project_id', NEW.project_id,
-							'hashtag_name', hashtag_name
-						)
-					)::text);
-					RETURN NEW;
-				END;
-				$$ LANGUAGE plpgsql;
-			`,
-		},
-		{
-			Name: "users_projects_data_changes",
-			Statement: `
-				CREATE OR REPLACE FUNCTION users_projects_data_changes()
-				RETURNS TRIGGER AS $$
-				DECLARE
-					user_info JSONB;
-				BEGIN
-					SELECT row_to_json(u) INTO user_info FROM users u WHERE u.id = NEW.user_id;
-					PERFORM pg_notify('data_changes', json_build_object(
-						'trigger_name', 'users_projects_data_changes',
-						'table_name', TG_TABLE_NAME,
-						'entry', json_build_object(
-							'project_id', NEW.project_id,
-							'user', user_info
-						)
-					)::text);
-					RETURN NEW;
-				END;
-				$$ LANGUAGE plpgsql;
-			`,
-		},
-	}
-
-	for _, trigger := range triggersToCreate {
-		// Check if trigger already exists
-		existsQuery := fmt.Sprintf("SELECT 1 FROM pg_trigger WHERE tgname = '%s'", trigger.Name)
-		var exists bool
-		err := pgDB.QueryRow(existsQuery).Scan(&exists)
-		if err != nil && err != sql.ErrNoRows {
+// Function shared by all triggers to record a row change with both row images, the transaction
+// id and the position of the change in its transaction. Changed fields lists the indexed columns
+// an update changed if the images only hold those, NULL if they are complete. The sequence lives in a transaction local
+// setting. The event is written to the outbox in the same transaction, the notification only wakes the worker
+const recordRowChangeStatement = `
+	CREATE OR REPLACE FUNCTION record_row_change(table_name TEXT, operation TEXT, old_row JSONB, new_row JSONB, changed_fields TEXT[])
+	RETURNS VOID AS $$
+	DECLARE
+		seq INTEGER;
+	BEGIN
+		seq := COALESCE(NULLIF(current_setting('fold.tx_seq', true), ''), '0')::INTEGER + 1;
+		PERFORM set_config('fold.tx_seq', seq::TEXT, true);
+
+		INSERT INTO sync_outbox (table_name, operation, txid, tx_seq, old_row, new_row, changed_fields)
+		VALUES (table_name, operation, txid_current(), seq, old_row, new_row, changed_fields);
+		PERFORM pg_notify('data_changes', '');
+	END;
+	$$ LANGUAGE plpgsql;
+`
+
+// Function shared by the statement level triggers to record one event per statement listing the
+// affected projects instead of the rows. It takes its place in the transaction like a row change
+const recordStatementChangeStatement = `
+	CREATE OR REPLACE FUNCTION record_statement_change(table_name TEXT, operation TEXT, project_ids INTEGER[])
+	RETURNS VOID AS $$
+	DECLARE
+		seq INTEGER;
+	BEGIN
+		seq := COALESCE(NULLIF(current_setting('fold.tx_seq', true), ''), '0')::INTEGER + 1;
+		PERFORM set_config('fold.tx_seq', seq::TEXT, true);
+
+		INSERT INTO sync_outbox (table_name, operation, txid, tx_seq, project_ids)
+		VALUES (table_name, operation, txid_current(), seq, project_ids);
+		PERFORM pg_notify('data_changes', '');
+	END;
+	$$ LANGUAGE plpgsql;
+`
+
+// Function to create the triggers of every pipeline table for the given mode. Triggers
+// of the other mode are removed so a change is never recorded twice
+func createTriggers(pgDB *sql.DB, mode string) error {
+	if mode != triggerModeRow && mode != triggerModeStatement {
+		return fmt.Errorf("unknown trigger mode %q, expected row or statement", mode)
+	}
+
+	for _, statement := range []string{recordRowChangeStatement, recordStatementChangeStatement} {
+		_, err := pgDB.Exec(statement)
+		if err != nil {
 			return err
 		}
-		if !exists {
-			// Create the trigger if it doesn't exist
-			_, err := pgDB.Exec(trigger.Statement)
-			if err != nil {
-				return err
-			}
+	}
 
-			// Attach the trigger to the appropriate table
-			triggerAttachStatement := fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION %s();",
-				trigger.Name, getTableNameFromTriggerName(trigger.Name), trigger.Name)
-			_, err = pgDB.Exec(triggerAttachStatement)
-			if err != nil {
-				return err
-			}
+	for _, table := range pipeline.tables() {
+		var err error
+		if mode == triggerModeStatement {
+			err = createStatementTriggers(pgDB, table)
+		} else {
+			err = createRowTrigger(pgDB, table)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func getTableNameFromTriggerName(triggerName string) string {
-	// Map trigger names to their corresponding table names
-	triggerToTableMap := map[string]string{
-		"projects_data_changes":         "projects",
-		"project_hashtags_data_changes": "project_hashtags",
-		"users_projects_data_changes":   "users_projects",
-	}
+// Function to create the row level trigger of a table, named after the table
+func createRowTrigger(pgDB *sql.DB, table string) error {
+	triggerName := table + "_data_changes"
 
-	return triggerToTableMap[triggerName]
-}
+	// Always replace the trigger function so payload changes reach existing databases
+	_, err := pgDB.Exec(pipeline.triggerStatement(table))
+	if err != nil {
+		return err
+	}
 
-func startNotificationListener(pgDB *sql.DB, esClient *elasticsearch.Client, pgConnStr string) {
-	// Set up PostgreSQL listener
-	listener := pq.NewListener(pgConnStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+	for _, trigger := range statementTriggerNames(table) {
+		_, err = pgDB.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", trigger, table))
 		if err != nil {
-			log.Printf("Listener error: %v", err)
+			return err
 		}
-	})
-	defer listener.Close()
+	}
+
+	exists, err := triggerExists(pgDB, triggerName)
+	if err != nil || exists {
+		return err
+	}
 
-	// Add PostgreSQL notifications to listener
-	err := listener.Listen("data_changes")
+	// Attach the trigger to the appropriate table
+	triggerAttachStatement := fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION %s();",
+		triggerName, table, triggerName)
+	_, err = pgDB.Exec(triggerAttachStatement)
+	return err
+}
+
+// Function to create the statement level triggers of a table. Each operation gets a trigger
+// of its own referencing only the transition tables it has
+func createStatementTriggers(pgDB *sql.DB, table string) error {
+	_, err := pgDB.Exec(pipeline.statementTriggerStatement(table))
 	if err != nil {
-		log.Fatalf("Error setting up LISTEN channel: %v", err)
+		return err
 	}
 
-	// Start listening for notifications
-	for {
-		notification, ok := <-listener.Notify
-		if !ok {
-			return
-		}
+	_, err = pgDB.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s_data_changes ON %s", table, table))
+	if err != nil {
+		return err
+	}
 
-		// Process the notification payload
-		var payload map[string]interface{}
-		err := json.Unmarshal([]byte(notification.Extra), &payload)
+	transitionTables := map[string]string{
+		"INSERT": "NEW TABLE AS new_rows",
+		"UPDATE": "OLD TABLE AS old_rows NEW TABLE AS new_rows",
+		"DELETE": "OLD TABLE AS old_rows",
+	}
+	for _, operation := range []string{"INSERT", "UPDATE", "DELETE"} {
+		triggerName := fmt.Sprintf("%s_statement_%s", table, strings.ToLower(operation))
+		exists, err := triggerExists(pgDB, triggerName)
 		if err != nil {
-			log.Printf("Error decoding notification payload: %v", err)
+			return err
+		}
+		if exists {
 			continue
 		}
 
-		triggerName := payload["trigger_name"].(string)
-		tableName := payload["table_name"].(string)
-		entry := payload["entry"].(map[string]interface{})
-
-		err = syncDataToElasticsearch(pgDB, esClient, triggerName, tableName, entry)
+		triggerAttachStatement := fmt.Sprintf("CREATE TRIGGER %s AFTER %s ON %s REFERENCING %s FOR EACH STATEMENT EXECUTE FUNCTION %s_statement_changes();",
+			triggerName, operation, table, transitionTables[operation], table)
+		_, err = pgDB.Exec(triggerAttachStatement)
 		if err != nil {
-			fmt.Printf("Error syncing data to Elasticsearch: %v", err)
+			return err
 		}
 	}
+	return nil
+}
+
+func statementTriggerNames(table string) []string {
+	return []string{table + "_statement_insert", table + "_statement_update", table + "_statement_delete"}
+}
+
+func triggerExists(pgDB *sql.DB, triggerName string) (bool, error) {
+	var exists bool
+	err := pgDB.QueryRow("SELECT true FROM pg_trigger WHERE tgname = $1", triggerName).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return exists, err
 }
 
 // Function to clear tables
@@ -217,6 +270,8 @@ func clearTables(pgDB *sql.DB) {
 		"users",
 		"hashtags",
 		"projects",
+		"sync_outbox",
+		"sync_dead_letters",
 	}
 
 	removeTriggers(pgDB)
@@ -232,17 +287,13 @@ func clearTables(pgDB *sql.DB) {
 }
 
 func removeTriggers(pgDB *sql.DB) {
-	triggersToRemove := []string{"project_hashtags_data_changes", "users_projects_data_changes", "projects_data_changes"}
-	var triggerTableMap = map[string]string{
-		"projects_data_changes":         "projects",
-		"project_hashtags_data_changes": "project_hashtags",
-		"users_projects_data_changes":   "users_projects",
-	}
-
-	for _, trigger := range triggersToRemove {
-		_, err := pgDB.Exec(fmt.Sprintf("DROP TRIGGER %s ON %s", trigger, triggerTableMap[trigger]))
-		if err != nil {
-			log.Printf("Error removing trigger %s: %v", trigger, err)
+	for _, table := range pipeline.tables() {
+		triggers := append([]string{table + "_data_changes"}, statementTriggerNames(table)...)
+		for _, trigger := range triggers {
+			_, err := pgDB.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", trigger, table))
+			if err != nil {
+				log.Printf("Error removing trigger %s: %v", trigger, err)
+			}
 		}
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Keyset paginated query building the complete elasticsearch documents of all projects in id order
+func projectDocumentPageQuery() string {
+	return fmt.Sprintf("SELECT p.%s, %s FROM %s p WHERE p.%s > $1 ORDER BY p.%s LIMIT $2",
+		pipeline.Root.PrimaryKey, pipeline.documentExpression(), pipeline.Root.Table, pipeline.Root.PrimaryKey, pipeline.Root.PrimaryKey)
+}
+
+// Variant building the documents of a list of projects at once
+func projectDocumentsQuery() string {
+	return fmt.Sprintf("SELECT p.%s, %s FROM %s p WHERE p.%s = ANY($1)",
+		pipeline.Root.PrimaryKey, pipeline.documentExpression(), pipeline.Root.Table, pipeline.Root.PrimaryKey)
+}
+
+// Field of every document holding the version it was written with
+const syncVersionField = "sync_version"
+
+// Query reading the current WAL insert position. Documents are versioned with the position read
+// before their data, a newer read can't get a lower version, so a stale write can't replace a newer one
+const syncVersionQuery = "SELECT (pg_current_wal_insert_lsn() - '0/0')::BIGINT"
+
+type projectDocument struct {
+	ID       int
+	Document json.RawMessage
+	Version  int64
+}
+
+// Function to read the version of documents built from data read afterwards
+func currentSyncVersion(queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int64, error) {
+	var version int64
+	err := queryer.QueryRow(syncVersionQuery).Scan(&version)
+	return version, err
+}
+
+// Function to build the documents of the next page of projects with an id greater than afterID.
+// The documents get the version read when the snapshot of the transaction was taken
+func buildProjectDocumentPage(tx *sql.Tx, afterID int, limit int, version int64) ([]projectDocument, error) {
+	rows, err := tx.Query(projectDocumentPageQuery(), afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var documents []projectDocument
+	for rows.Next() {
+		var id int
+		var documentJSON []byte
+		if err := rows.Scan(&id, &documentJSON); err != nil {
+			return nil, err
+		}
+		documents = append(documents, projectDocument{ID: id, Document: documentJSON, Version: version})
+	}
+
+	return documents, rows.Err()
+}
+
+// Function to build the documents of several projects with one query, by project id.
+// Projects that don't exist are left out
+func buildProjectDocuments(pgDB *sql.DB, projectIDs []int) (map[int]json.RawMessage, error) {
+	ids := make([]int64, 0, len(projectIDs))
+	for _, projectID := range projectIDs {
+		ids = append(ids, int64(projectID))
+	}
+
+	rows, err := pgDB.Query(projectDocumentsQuery(), pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := map[int]json.RawMessage{}
+	for rows.Next() {
+		var id int
+		var documentJSON []byte
+		if err := rows.Scan(&id, &documentJSON); err != nil {
+			return nil, err
+		}
+		documents[id] = documentJSON
+	}
+
+	return documents, rows.Err()
+}
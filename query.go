@@ -107,7 +107,7 @@ func executeSearchRequest(esClient *elasticsearch.Client, ctx context.Context, r
 
 	var result map[string]interface{}
 	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		fmt.Println("decoder failed: %v", err)
+		fmt.Printf("decoder failed: %v\n", err)
 		return nil, err
 	}
 
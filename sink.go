@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Destination of the document changes produced by the pipeline
+type Sink interface {
+	// Replace the whole document, creating it if it doesn't exist. Every write carries the
+	// version of the data it was built from, a write older than the stored document is skipped
+	UpsertDocument(ctx context.Context, id string, document json.RawMessage, version int64) error
+	// Replace several whole documents at once
+	UpsertDocuments(ctx context.Context, documents []projectDocument) error
+	// Merge the given fields into an existing document
+	UpdateDocument(ctx context.Context, id string, fields map[string]interface{}, version int64) error
+	// Remove a document. Removing a missing document is not an error
+	DeleteDocument(ctx context.Context, id string, version int64) error
+	// Make every write done so far durable and visible
+	Flush(ctx context.Context) error
+}
+
+// Default size at which the NDJSON sink starts a new file
+const ndjsonSinkMaxBytes = 100 * 1024 * 1024
+
+// Sink writing every document change as one JSON line to local files.
+// A new file is started once the current one would grow past maxBytes
+type ndjsonSink struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	sequence int
+}
+
+// One line of the NDJSON sink output
+type ndjsonChange struct {
+	Time     time.Time              `json:"time"`
+	Op       string                 `json:"op"`
+	ID       string                 `json:"id"`
+	Document json.RawMessage        `json:"document,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+	Version  int64                  `json:"version"`
+}
+
+func newNDJSONSink(dir string, maxBytes int64) (*ndjsonSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (s *ndjsonSink) UpsertDocument(ctx context.Context, id string, document json.RawMessage, version int64) error {
+	return s.write(ndjsonChange{Op: "upsert", ID: id, Document: document, Version: version})
+}
+
+func (s *ndjsonSink) UpsertDocuments(ctx context.Context, documents []projectDocument) error {
+	for _, document := range documents {
+		err := s.UpsertDocument(ctx, strconv.Itoa(document.ID), document.Document, document.Version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ndjsonSink) UpdateDocument(ctx context.Context, id string, fields map[string]interface{}, version int64) error {
+	return s.write(ndjsonChange{Op: "update", ID: id, Fields: fields, Version: version})
+}
+
+func (s *ndjsonSink) DeleteDocument(ctx context.Context, id string, version int64) error {
+	return s.write(ndjsonChange{Op: "delete", ID: id, Version: version})
+}
+
+func (s *ndjsonSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+func (s *ndjsonSink) write(change ndjsonChange) error {
+	change.Time = time.Now().UTC()
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil || s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Function to close the current file and start the next one. Must be called with mu held
+func (s *ndjsonSink) rotate() error {
+	if s.file != nil {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+	}
+
+	s.sequence++
+	name := fmt.Sprintf("changes-%s-%06d.ndjson", time.Now().UTC().Format("20060102T150405"), s.sequence)
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.size = 0
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// A row change captured from postgres. Row values are in postgres text format,
+// NULL columns are left out. Seq numbers the changes of a transaction from 1,
+// events without a transaction id are treated as transactions of their own. The commit
+// time is only known to logical replication, triggers run before the commit and leave it zero
+type ChangeEvent struct {
+	Table      string            `json:"table"`
+	Operation  string            `json:"operation"`
+	OldRow     map[string]string `json:"old_row,omitempty"`
+	NewRow     map[string]string `json:"new_row,omitempty"`
+	TxID       int64             `json:"txid"`
+	Seq        int               `json:"seq"`
+	CommitTime time.Time         `json:"commit_time"`
+	// Projects affected by a statement, set by statement level triggers instead of the rows
+	ProjectIDs []int `json:"project_ids,omitempty"`
+	// Indexed columns changed by an update whose row images only hold the key and those columns
+	ChangedFields []string `json:"changed_fields,omitempty"`
+
+	// Set by the outbox for the first delivery of an event. Only then are its row values known
+	// to be the newest, replayed or redelivered events may be older than the stored documents
+	live bool
+}
+
+// Consumer of the events of a source. Handle may buffer the resulting writes,
+// they are only confirmed once Flush returns nil. Discard drops the events received
+// so far of a transaction the source failed to deliver completely
+type ChangeHandler interface {
+	Handle(event ChangeEvent) error
+	Flush() error
+	Discard(txID int64)
+}
+
+// Source of row changes. Run delivers events in commit order to the handler until ctx
+// is done or the source fails for good. The events of a transaction are delivered
+// together, and Flush is only called between transactions. Events are consumed once they are handled and
+// flushed, events that weren't are delivered again, in order, before anything that follows them
+type Source interface {
+	Run(ctx context.Context, handler ChangeHandler) error
+}
+
+// Delay before a stopped source is restarted, doubled while it keeps failing
+const sourceRestartDelay = 1 * time.Second
+const sourceMaxRestartDelay = time.Minute
+
+// Function to pick the change source configured through CDC_SOURCE
+func newSource(cdcSource string, pgDB *sql.DB, pgConnStr string) (Source, error) {
+	switch cdcSource {
+	case "", "triggers":
+		return newOutboxSource(pgDB, pgConnStr), nil
+	case "outbox":
+		return newOutboxSource(pgDB, ""), nil
+	case "logical":
+		return newReplicationSource(pgDB), nil
+	case "replay":
+		return newReplaySource(os.Getenv("REPLAY_FILE")), nil
+	default:
+		return nil, fmt.Errorf("unknown CDC_SOURCE %q", cdcSource)
+	}
+}
+
+// Function to run a source until ctx is done, restarting it whenever it fails or panics.
+// Events that were not consumed when the source stopped are delivered again after the restart
+func superviseSource(ctx context.Context, source Source, handler ChangeHandler) {
+	delay := sourceRestartDelay
+	for {
+		started := time.Now()
+		err := runSource(ctx, source, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			log.Printf("Change source finished")
+			return
+		}
+
+		// A source that ran for a while before failing starts over with the short delay
+		if time.Since(started) > sourceMaxRestartDelay {
+			delay = sourceRestartDelay
+		}
+		log.Printf("Change source stopped: %v, restarting in %s", err, delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > sourceMaxRestartDelay {
+			delay = sourceMaxRestartDelay
+		}
+	}
+}
+
+// Function to run a source once, a panic in the source or in the handler is returned as an error
+func runSource(ctx context.Context, source Source, handler ChangeHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return source.Run(ctx, handler)
+}
+
+// Function to check that an event names a synced table and carries the row images its operation needs
+func (event ChangeEvent) validate() error {
+	if len(pipeline.tableRoles(event.Table)) == 0 {
+		return fmt.Errorf("change event for unknown table %q", event.Table)
+	}
+
+	// Statement events only list the affected projects
+	if len(event.ProjectIDs) > 0 {
+		switch event.Operation {
+		case "INSERT", "UPDATE", "DELETE":
+			return nil
+		}
+		return fmt.Errorf("change event on %s with unknown operation %q", event.Table, event.Operation)
+	}
+
+	if event.ChangedFields != nil && event.Operation != "UPDATE" {
+		return fmt.Errorf("%s event on %s with changed fields", event.Operation, event.Table)
+	}
+
+	switch event.Operation {
+	case "INSERT", "UPDATE":
+		// The old image of an update is only sent by logical replication if the key changed
+		if event.NewRow == nil {
+			return fmt.Errorf("%s event on %s without new row", event.Operation, event.Table)
+		}
+	case "DELETE":
+		if event.OldRow == nil {
+			return fmt.Errorf("DELETE event on %s without old row", event.Table)
+		}
+	default:
+		return fmt.Errorf("change event on %s with unknown operation %q", event.Table, event.Operation)
+	}
+	return nil
+}
+
+// Function to decode and validate a JSON encoded change event, unknown fields are rejected
+func decodeChangeEvent(data []byte) (ChangeEvent, error) {
+	var event ChangeEvent
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&event); err != nil {
+		return ChangeEvent{}, err
+	}
+	if err := event.validate(); err != nil {
+		return ChangeEvent{}, err
+	}
+	return event, nil
+}
+
+// Function to validate a change event and list the projects whose documents it affects
+func changeEventProjects(pgDB *sql.DB, event ChangeEvent) ([]int, error) {
+	err := event.validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(event.ProjectIDs) > 0 {
+		return event.ProjectIDs, nil
+	}
+	return projectIDsForChange(pgDB, event)
+}
+
+// Number of events a replay handles before it flushes at the next transaction boundary
+const replayFlushEvents = 1000
+
+// Source reading change events from a file with one JSON encoded event per line,
+// used to replay captured changes against a sink. The handler is flushed between
+// transactions as the replay goes, a restarted replay skips the lines already flushed
+type replaySource struct {
+	path string
+	// Lines of the file whose events are flushed
+	flushed int
+}
+
+func newReplaySource(path string) *replaySource {
+	return &replaySource{path: path}
+}
+
+func (s *replaySource) Run(ctx context.Context, handler ChangeHandler) error {
+	if s.path == "" {
+		return fmt.Errorf("REPLAY_FILE is not set")
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	handled := 0
+	var txID int64
+	for scanner.Scan() {
+		line++
+		if line <= s.flushed || len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		event, err := decodeChangeEvent(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", s.path, line, err)
+		}
+
+		// The previous transaction is complete once an event of another one starts
+		if handled >= replayFlushEvents && (event.TxID == 0 || event.TxID != txID) {
+			if err := handler.Flush(); err != nil {
+				return err
+			}
+			s.flushed = line - 1
+			handled = 0
+		}
+
+		// Stop at the first failure, the restarted replay continues after the last flush
+		if err := handler.Handle(event); err != nil {
+			handler.Discard(event.TxID)
+			return fmt.Errorf("%s:%d: %v", s.path, line, err)
+		}
+		handled++
+		txID = event.TxID
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := handler.Flush(); err != nil {
+		return err
+	}
+	s.flushed = line
+	return nil
+}
+
+// Function to list the projects whose documents include the changed row
+func projectIDsForChange(pgDB *sql.DB, change ChangeEvent) ([]int, error) {
+	roles := pipeline.tableRoles(change.Table)
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("unexpected change for table %s", change.Table)
+	}
+
+	seen := map[int]bool{}
+	var projectIDs []int
+	addProjectID := func(projectID int) {
+		if !seen[projectID] {
+			seen[projectID] = true
+			projectIDs = append(projectIDs, projectID)
+		}
+	}
+
+	for _, role := range roles {
+		var column string
+		switch role.Kind {
+		case "root":
+			column = pipeline.Root.PrimaryKey
+		case "join":
+			column = role.Child.JoinRootKey
+		case "child":
+			column = role.Child.PrimaryKey
+		}
+
+		// Both row images count, a moved association changes the old and the new project
+		ids, err := changeEventIDs(change, column)
+		if err != nil {
+			return nil, err
+		}
+
+		if role.Kind != "child" {
+			for _, id := range ids {
+				addProjectID(id)
+			}
+			continue
+		}
+
+		// Child rows are copied into every project they are linked to
+		for _, id := range ids {
+			rows, err := pgDB.Query(pipeline.linkedRootsQuery(role.Child, "$1"), id)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var projectID int
+				if err := rows.Scan(&projectID); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				addProjectID(projectID)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return projectIDs, nil
+}
+
+// Function to read an integer column from the old and new row images of a change
+func changeEventIDs(change ChangeEvent, column string) ([]int, error) {
+	var ids []int
+	for _, row := range []map[string]string{change.OldRow, change.NewRow} {
+		value, ok := row[column]
+		if !ok {
+			continue
+		}
+		var id int
+		if _, err := fmt.Sscan(value, &id); err != nil {
+			return nil, fmt.Errorf("invalid %s.%s value %q", change.Table, column, value)
+		}
+		if len(ids) == 0 || ids[0] != id {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -4,142 +4,221 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
-	"strings"
-
-	"github.com/elastic/go-elasticsearch/v8/esapi"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v8"
 )
 
-func syncDataToElasticsearch(pgDB *sql.DB, esClient *elasticsearch.Client, triggerName string, tableName string, entry map[string]interface{}) error {
-	// Handle the change based on trigger and table
-	switch triggerName {
-	case "projects_data_changes":
-		// Call a function to handle Elasticsearch indexing or updating
-		entry["hashtags"] = []string{}
-		entry["users"] = []interface{}{}
-		syncDataToElasticsearchForProjects(esClient, entry)
-	case "project_hashtags_data_changes":
-		// Call a function to handle Elasticsearch indexing or updating
-		err := syncDataToElasticsearchForProjectHashtags(esClient, entry)
-		if err != nil {
-			fmt.Println("hashtags update failed: %v", err)
-		}
-	case "users_projects_data_changes":
-		// Call a function to handle Elasticsearch indexing or updating
-		err := syncDataToElasticsearchForUsersProjects(esClient, entry)
-		if err != nil {
-			fmt.Println("hashtags update failed: %v", err)
+// Function to write a batch of project changes to every sink. Projects are rebuilt unless only
+// indexed columns of their root row changed, those get a partial update with the new values.
+// Returns the error of each project that could not be synced, or an error if the batch failed as a whole
+func syncProjectsToSinks(pgDB *sql.DB, changes *projectChanges) (map[int]error, error) {
+	// A partial update can't reach documents the backfill of a reindex hasn't written yet
+	projectsIndex.Lock()
+	reindexing := projectsIndex.touched != nil
+	projectsIndex.Unlock()
+
+	var rebuildIDs []int
+	for _, projectID := range changes.ProjectIDs {
+		if _, partial := changes.Updates[projectID]; !partial || reindexing {
+			rebuildIDs = append(rebuildIDs, projectID)
 		}
-	default:
-		fmt.Println("Unknown trigger:", triggerName)
 	}
-	return nil
-}
 
-// Function to sync projects table updates to elastic search
-func syncDataToElasticsearchForProjects(esClient *elasticsearch.Client, project map[string]interface{}) error {
-	ctx := context.Background()
-
-	// Convert project data to JSON
-	projectJSON, err := json.Marshal(project)
+	// The version is read before the data, so every write of the batch is at least as new as it
+	version, err := currentSyncVersion(pgDB)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to read sync version: %w", err)
 	}
 
-	// Index the project data in Elasticsearch
-	req := esapi.IndexRequest{
-		Index:      projects_mapping_index,
-		DocumentID: strconv.Itoa(int(project["id"].(float64))), // Assuming "id" is an integer
-		Body:       strings.NewReader(string(projectJSON)),
-		Refresh:    "true",
+	// Every other change is applied by rebuilding the affected projects from postgres,
+	// so a missed or reordered notification is repaired by the next one.
+	// The documents are built before locking so different batches are rebuilt in parallel
+	documents := map[int]json.RawMessage{}
+	if len(rebuildIDs) > 0 {
+		documents, err = buildProjectDocuments(pgDB, rebuildIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build projects %v: %w", rebuildIDs, err)
+		}
 	}
 
-	res, err := req.Do(ctx, esClient)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+	projectsIndex.Lock()
+	defer projectsIndex.Unlock()
 
-	if res.IsError() {
-		return fmt.Errorf("failed to index document: %s", res.Status())
+	// A reindex started while the documents were built, the partially updated projects are rebuilt as well
+	if !reindexing && projectsIndex.touched != nil {
+		reindexing = true
+		var updatedIDs []int
+		for projectID := range changes.Updates {
+			updatedIDs = append(updatedIDs, projectID)
+		}
+		if len(updatedIDs) > 0 {
+			updated, err := buildProjectDocuments(pgDB, updatedIDs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to build projects %v: %w", updatedIDs, err)
+			}
+			for projectID, document := range updated {
+				documents[projectID] = document
+			}
+		}
 	}
 
-	return nil
-}
+	failed := map[int]error{}
+	for _, projectID := range changes.ProjectIDs {
+		fields, partial := changes.Updates[projectID]
+		partial = partial && !reindexing
+
+		for _, sink := range projectsIndex.sinks {
+			var err error
+			if partial {
+				err = sink.UpdateDocument(context.Background(), strconv.Itoa(projectID), fields, version)
+			} else {
+				// Projects missing from postgres were deleted, their documents are removed
+				err = writeProjectToSink(sink, projectID, documents[projectID], version)
+			}
+			if err != nil {
+				failed[projectID] = fmt.Errorf("failed to sync project %d: %w", projectID, err)
+				break
+			}
+		}
 
-// Function to sync project_hashtags table updates to elastic search
-func syncDataToElasticsearchForProjectHashtags(esClient *elasticsearch.Client, projectHashtag map[string]interface{}) error {
-	ctx := context.Background()
+		if _, ok := failed[projectID]; !ok && projectsIndex.touched != nil {
+			projectsIndex.touched[projectID] = true
+		}
+	}
+	return failed, nil
+}
 
-	projectID := int(projectHashtag["project_id"].(float64))
-	hashtagName := projectHashtag["hashtag_name"].(string)
+// Function to tell whether an event only changed indexed columns of a root row, which are then
+// copied into the document without rebuilding it. Returns the project and the new column values.
+// The update is versioned when it is applied, so only live events can skip the rebuild
+func rootFieldUpdate(event ChangeEvent) (int, map[string]interface{}, bool) {
+	if !event.live || event.Table != pipeline.Root.Table || event.Operation != "UPDATE" || event.ChangedFields == nil {
+		return 0, nil, false
+	}
 
-	script := fmt.Sprintf(`{
-        "script": {
-            "source": "ctx._source.hashtags.add('%s')",
-            "lang": "painless"
-        }
-    }`, hashtagName)
+	rootFields := map[string]pipelineField{}
+	for _, field := range pipeline.Root.Fields {
+		rootFields[field.Name] = field
+	}
 
-	req := esapi.UpdateRequest{
-		Index:      projects_mapping_index,
-		DocumentID: strconv.Itoa(projectID),
-		Body:       strings.NewReader(script),
+	fields := map[string]interface{}{}
+	for _, column := range event.ChangedFields {
+		// Changes of the key or of a scalar child reference need the document rebuilt
+		field, ok := rootFields[column]
+		if !ok || column == pipeline.Root.PrimaryKey {
+			return 0, nil, false
+		}
+		value, ok := event.NewRow[column]
+		if !ok {
+			fields[column] = nil
+			continue
+		}
+		fields[column] = documentFieldValue(field, value)
 	}
 
-	res, err := req.Do(ctx, esClient)
+	projectID, err := strconv.Atoi(event.NewRow[pipeline.Root.PrimaryKey])
 	if err != nil {
-		return err
+		return 0, nil, false
 	}
-	defer res.Body.Close()
+	return projectID, fields, true
+}
 
-	if res.IsError() {
-		return fmt.Errorf("update document failed: %v", res.String())
+// Function to convert a column value in postgres text format to its value in the document
+func documentFieldValue(field pipelineField, value string) interface{} {
+	switch field.Type {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "boolean":
+		if json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
 	}
+	return value
+}
 
-	return nil
+// Function to flush every sink. Returns the projects whose documents could not be written,
+// or an error if the writes can't be confirmed at all
+func flushSinks(ctx context.Context) (map[int]error, error) {
+	projectsIndex.Lock()
+	defer projectsIndex.Unlock()
+
+	failed := map[int]error{}
+	for _, sink := range projectsIndex.sinks {
+		err := sink.Flush(ctx)
+		var bulkErr *bulkError
+		if errors.As(err, &bulkErr) {
+			for id, itemErr := range bulkErr.Failures {
+				projectID, err := strconv.Atoi(id)
+				if err != nil {
+					return nil, fmt.Errorf("unexpected document id %q: %v", id, itemErr)
+				}
+				failed[projectID] = itemErr
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failed, nil
 }
 
-// Function to sync users_projects table updates to elastic search
-func syncDataToElasticsearchForUsersProjects(esClient *elasticsearch.Client, userProject map[string]interface{}) error {
+// Function to write a rebuilt project to a sink, a nil document removes the project
+func writeProjectToSink(sink Sink, projectID int, document json.RawMessage, version int64) error {
 	ctx := context.Background()
+	id := strconv.Itoa(projectID)
 
-	projectID := int(userProject["project_id"].(float64))
-	userInfo := userProject["user"].(map[string]interface{})
-	userID := int(userInfo["id"].(float64))
-	userName := userInfo["name"].(string)
-	userCreatedAt := userInfo["created_at"].(string)
-
-	script := fmt.Sprintf(`{
-        "script": {
-            "source": "ctx._source.users.add(params)",
-            "lang": "painless",
-            "params": {
-                "name": "%s",
-				"id": %d,
-				"created_at": "%s"
-            }
-        }
-    }`, userName, userID, userCreatedAt)
-
-	req := esapi.UpdateRequest{
-		Index:      projects_mapping_index, // Update with your actual index name
-		DocumentID: strconv.Itoa(projectID),
-		Body:       strings.NewReader(script),
+	if document == nil {
+		return sink.DeleteDocument(ctx, id, version)
 	}
+	return sink.UpsertDocument(ctx, id, document, version)
+}
 
-	res, err := req.Do(ctx, esClient)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+// Sink writing documents to a single elasticsearch index or alias. Writes are
+// buffered and sent in bulk, they are only guaranteed to be written once Flush returns
+type elasticsearchSink struct {
+	esClient  *elasticsearch.Client
+	indexName string
+	writer    *bulkWriter
+}
 
-	if res.IsError() {
-		return fmt.Errorf("update document failed: %v", res)
+func newElasticsearchSink(esClient *elasticsearch.Client, indexName string) *elasticsearchSink {
+	return &elasticsearchSink{
+		esClient:  esClient,
+		indexName: indexName,
+		writer:    newBulkWriter(esClient, indexName, esBulkConfig),
 	}
+}
+
+// Function to upsert a complete project document to elastic search
+func (s *elasticsearchSink) UpsertDocument(ctx context.Context, id string, document json.RawMessage, version int64) error {
+	return s.writer.index(ctx, id, document, version)
+}
 
+// Function to index several project documents, the writer splits them into bulk requests
+func (s *elasticsearchSink) UpsertDocuments(ctx context.Context, documents []projectDocument) error {
+	for _, document := range documents {
+		err := s.writer.index(ctx, strconv.Itoa(document.ID), document.Document, document.Version)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Function to merge fields into an existing project document
+func (s *elasticsearchSink) UpdateDocument(ctx context.Context, id string, fields map[string]interface{}, version int64) error {
+	return s.writer.update(ctx, id, fields, version)
+}
+
+// Function to remove a deleted project from elastic search. A missing document
+// means the project was never synced, bulk deletes don't report it as an error
+func (s *elasticsearchSink) DeleteDocument(ctx context.Context, id string, version int64) error {
+	return s.writer.delete(ctx, id, version)
+}
+
+// Function to send the buffered writes, see bulkWriter.Flush for the errors
+func (s *elasticsearchSink) Flush(ctx context.Context) error {
+	return s.writer.Flush(ctx)
+}
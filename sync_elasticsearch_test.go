@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRootFieldUpdate(t *testing.T) {
+	pipeline = newTestPipelineSpec()
+
+	update := func(changedFields []string, newRow string) ChangeEvent {
+		row, err := outboxRow([]byte(newRow))
+		if err != nil {
+			t.Fatalf("invalid row %s: %v", newRow, err)
+		}
+		return ChangeEvent{
+			Table:         "projects",
+			Operation:     "UPDATE",
+			OldRow:        map[string]string{"id": "1"},
+			NewRow:        row,
+			ChangedFields: changedFields,
+			live:          true,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		event   ChangeEvent
+		partial bool
+		// Fields of the partial update as sent to elasticsearch
+		fields string
+	}{
+		{
+			name:    "changed fields",
+			event:   update([]string{"name", "budget"}, `{"id": 1, "name": "fold", "budget": 1200}`),
+			partial: true,
+			fields:  `{"budget":1200,"name":"fold"}`,
+		},
+		{
+			name:    "field set to null",
+			event:   update([]string{"name"}, `{"id": 1, "name": null}`),
+			partial: true,
+			fields:  `{"name":null}`,
+		},
+		{
+			name:  "changed key",
+			event: update([]string{"id", "name"}, `{"id": 2, "name": "fold"}`),
+		},
+		{
+			name:  "changed scalar child reference",
+			event: update([]string{"owner_id"}, `{"id": 1, "owner_id": 7}`),
+		},
+		{
+			name: "delivered again",
+			event: func() ChangeEvent {
+				event := update([]string{"name"}, `{"id": 1, "name": "fold"}`)
+				event.live = false
+				return event
+			}(),
+		},
+		{
+			name:  "without changed fields",
+			event: update(nil, `{"id": 1, "name": "fold"}`),
+		},
+		{
+			name: "other table",
+			event: func() ChangeEvent {
+				event := update([]string{"name"}, `{"id": 1, "name": "fold"}`)
+				event.Table = "users"
+				return event
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		projectID, fields, partial := rootFieldUpdate(test.event)
+		if partial != test.partial {
+			t.Errorf("%s: got partial %v, want %v", test.name, partial, test.partial)
+			continue
+		}
+		if !partial {
+			continue
+		}
+		if projectID != 1 {
+			t.Errorf("%s: got project %d, want 1", test.name, projectID)
+		}
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if string(encoded) != test.fields {
+			t.Errorf("%s: got fields %s, want %s", test.name, encoded, test.fields)
+		}
+	}
+}
+
+func TestDocumentFieldValue(t *testing.T) {
+	tests := []struct {
+		field pipelineField
+		value string
+		want  interface{}
+	}{
+		{field: pipelineField{Name: "budget", Type: "long"}, value: "1200", want: json.RawMessage("1200")},
+		{field: pipelineField{Name: "archived", Type: "boolean"}, value: "true", want: json.RawMessage("true")},
+		{field: pipelineField{Name: "name", Type: "text"}, value: "1200", want: "1200"},
+		// Postgres text that isn't valid JSON is kept as a string
+		{field: pipelineField{Name: "budget", Type: "double"}, value: "NaN", want: "NaN"},
+	}
+
+	for _, test := range tests {
+		if got := documentFieldValue(test.field, test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: got %#v, want %#v", test.field.Type, test.value, got, test.want)
+		}
+	}
+}
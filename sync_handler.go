@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings of the sync workers
+type syncHandlerConfig struct {
+	Workers int
+	// Project rebuilds queued for the workers in total
+	QueueSize int
+	// Time a project rebuild waits for more changes to the same project, zero rebuilds right away
+	Debounce time.Duration
+}
+
+// Most project rebuilds a worker takes from its queue at once and builds with a single query
+const syncBatchSize = 100
+
+var defaultSyncHandlerConfig = syncHandlerConfig{
+	Workers:   4,
+	QueueSize: 1000,
+	Debounce:  100 * time.Millisecond,
+}
+
+// Handler syncing change events into the sinks. Events are collected per transaction and
+// the projects of a transaction are only rebuilt once all its events arrived. Each affected
+// project is rebuilt by a worker picked by project id, so changes to a project stay ordered
+// while different projects sync in parallel. A rebuild is held back for the debounce window,
+// changes to the same project arriving meanwhile are merged into it. Rebuilds waiting for
+// their window and queued rebuilds share a bounded number of slots, once all of them are
+// taken the source blocks until a rebuild finishes.
+// Events whose documents can't be written are stored as dead letters, so one failing
+// project doesn't hold back the others. While elasticsearch is unavailable events
+// fail instead, the source delivers them again
+type syncHandler struct {
+	sync.Mutex
+	idle *sync.Cond
+	pgDB *sql.DB
+
+	queues []chan *syncJob
+	// One slot per scheduled, queued or running rebuild, sized by the queue size
+	slots    chan struct{}
+	debounce time.Duration
+	// Projects whose rebuild waits for the debounce window to pass
+	scheduled map[int]*syncJob
+	// Project rebuilds scheduled, queued or running
+	inFlight int
+
+	// Events of the transaction being received
+	openTransaction *transactionGroup
+
+	// Events handled since the last flush and the projects each of them rebuilt
+	pending []pendingEvent
+	// Projects whose rebuild failed since the last flush
+	failed map[int]error
+	// Error that dropped writes of pending events, reported by the next Flush
+	flushErr error
+}
+
+type pendingEvent struct {
+	Event      ChangeEvent
+	ProjectIDs []int
+}
+
+// Events of a transaction, collected until the transaction is complete
+type transactionGroup struct {
+	TxID   int64
+	Events []pendingEvent
+}
+
+// Rebuilds of a complete transaction whose documents aren't written yet
+type transactionState struct {
+	remaining  int
+	projectIDs []int
+}
+
+type syncJob struct {
+	ProjectID int
+	// New values of the changed root columns, nil if the project is rebuilt
+	Fields map[string]interface{}
+	// Transactions waiting for this rebuild
+	Transactions []*transactionState
+}
+
+// Queue depth of the sync workers, as reported by the status endpoint
+type syncQueueStatus struct {
+	Workers       int `json:"workers"`
+	Debouncing    int `json:"debouncing"`
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+	InFlight      int `json:"in_flight"`
+}
+
+// Function to read the sync worker settings from the environment, unset values keep their default
+func loadSyncHandlerConfig() (syncHandlerConfig, error) {
+	config := defaultSyncHandlerConfig
+
+	if value := os.Getenv("SYNC_WORKERS"); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers <= 0 {
+			return config, fmt.Errorf("invalid SYNC_WORKERS %q", value)
+		}
+		config.Workers = workers
+	}
+
+	if value := os.Getenv("SYNC_QUEUE_SIZE"); value != "" {
+		queueSize, err := strconv.Atoi(value)
+		if err != nil || queueSize <= 0 {
+			return config, fmt.Errorf("invalid SYNC_QUEUE_SIZE %q", value)
+		}
+		config.QueueSize = queueSize
+	}
+
+	if value := os.Getenv("SYNC_DEBOUNCE_MS"); value != "" {
+		debounce, err := strconv.Atoi(value)
+		if err != nil || debounce < 0 {
+			return config, fmt.Errorf("invalid SYNC_DEBOUNCE_MS %q", value)
+		}
+		config.Debounce = time.Duration(debounce) * time.Millisecond
+	}
+
+	return config, nil
+}
+
+func newSyncHandler(pgDB *sql.DB, config syncHandlerConfig) *syncHandler {
+	h := &syncHandler{
+		pgDB:      pgDB,
+		debounce:  config.Debounce,
+		slots:     make(chan struct{}, config.QueueSize),
+		scheduled: map[int]*syncJob{},
+		failed:    map[int]error{},
+	}
+	h.idle = sync.NewCond(&h.Mutex)
+
+	// The queue size is split between the workers
+	workerQueueSize := (config.QueueSize + config.Workers - 1) / config.Workers
+	for i := 0; i < config.Workers; i++ {
+		queue := make(chan *syncJob, workerQueueSize)
+		h.queues = append(h.queues, queue)
+		go h.runWorker(queue)
+	}
+	return h
+}
+
+func (h *syncHandler) Handle(event ChangeEvent) error {
+	err := esBreaker.wait(context.Background())
+	if err != nil {
+		return err
+	}
+
+	projectIDs, err := changeEventProjects(h.pgDB, event)
+	if err != nil {
+		log.Printf("Error syncing %s on %s, storing dead letter: %v", event.Operation, event.Table, err)
+		return insertDeadLetter(h.pgDB, event, err)
+	}
+
+	h.Lock()
+	var complete *transactionGroup
+	if h.openTransaction != nil && (event.TxID == 0 || event.TxID != h.openTransaction.TxID) {
+		complete, h.openTransaction = h.openTransaction, nil
+	}
+	if h.openTransaction == nil {
+		h.openTransaction = &transactionGroup{TxID: event.TxID}
+	}
+	h.openTransaction.Events = append(h.openTransaction.Events, pendingEvent{Event: event, ProjectIDs: projectIDs})
+	h.Unlock()
+
+	// The first event of the next transaction completes the previous one
+	if complete != nil {
+		h.applyTransaction(complete)
+	}
+	return nil
+}
+
+// Function to schedule the rebuilds of a complete transaction. Its documents are held back
+// from automatic flushes until all of them are written, so they go out in the same bulk request
+// as far as the bulk limits allow
+func (h *syncHandler) applyTransaction(group *transactionGroup) {
+	changes := newProjectChanges()
+	for _, pendingEvent := range group.Events {
+		updatedID, fields, partial := rootFieldUpdate(pendingEvent.Event)
+		for _, projectID := range pendingEvent.ProjectIDs {
+			if partial && projectID == updatedID {
+				changes.add(projectID, fields)
+			} else {
+				changes.add(projectID, nil)
+			}
+		}
+	}
+
+	var transaction *transactionState
+	if len(changes.ProjectIDs) > 0 {
+		transaction = &transactionState{remaining: len(changes.ProjectIDs), projectIDs: changes.ProjectIDs}
+		pendingTransactions.hold(changes.ProjectIDs)
+	}
+	h.enqueue(changes, transaction, group.Events)
+}
+
+// Changes to a set of projects. A project is rebuilt, or if only indexed columns of its
+// root row changed, updated with the new values of those columns
+type projectChanges struct {
+	ProjectIDs []int
+	// New column values of the projects that aren't rebuilt
+	Updates map[int]map[string]interface{}
+	rebuild map[int]bool
+}
+
+func newProjectChanges() *projectChanges {
+	return &projectChanges{Updates: map[int]map[string]interface{}{}, rebuild: map[int]bool{}}
+}
+
+// Function to add a change to a project, nil fields rebuild it. A rebuild reads the current
+// state so it covers every other change, later column values replace earlier ones
+func (c *projectChanges) add(projectID int, fields map[string]interface{}) {
+	if _, updated := c.Updates[projectID]; !updated && !c.rebuild[projectID] {
+		c.ProjectIDs = append(c.ProjectIDs, projectID)
+	}
+	if c.rebuild[projectID] {
+		return
+	}
+	if fields == nil {
+		c.rebuild[projectID] = true
+		delete(c.Updates, projectID)
+		return
+	}
+
+	if c.Updates[projectID] == nil {
+		c.Updates[projectID] = map[string]interface{}{}
+	}
+	for name, value := range fields {
+		c.Updates[projectID][name] = value
+	}
+}
+
+// Function to schedule the rebuild of each project, a project already waiting for its
+// debounce window absorbs the event. The events of the source are tracked as pending
+// until the next flush. Blocks while every slot is taken
+func (h *syncHandler) enqueue(changes *projectChanges, transaction *transactionState, pending []pendingEvent) {
+	// The change counts as in flight until all its rebuilds are scheduled, so a flush waits for them
+	h.Lock()
+	h.pending = append(h.pending, pending...)
+	h.inFlight++
+	h.Unlock()
+
+	for _, projectID := range changes.ProjectIDs {
+		h.slots <- struct{}{}
+
+		fields := changes.Updates[projectID]
+		h.Lock()
+		if job, ok := h.scheduled[projectID]; ok {
+			job.addTransaction(transaction)
+			job.addFields(fields)
+			h.Unlock()
+			<-h.slots
+			continue
+		}
+
+		job := &syncJob{ProjectID: projectID, Fields: fields}
+		job.addTransaction(transaction)
+		h.inFlight++
+		if h.debounce <= 0 {
+			h.Unlock()
+			h.dispatch(job)
+			continue
+		}
+
+		// The window starts with the first change, a steady stream of changes can't hold a project back
+		h.scheduled[projectID] = job
+		time.AfterFunc(h.debounce, func() {
+			h.Lock()
+			delete(h.scheduled, job.ProjectID)
+			h.Unlock()
+			h.dispatch(job)
+		})
+		h.Unlock()
+	}
+
+	h.Lock()
+	h.inFlight--
+	if h.inFlight == 0 {
+		h.idle.Broadcast()
+	}
+	h.Unlock()
+}
+
+func (job *syncJob) addTransaction(transaction *transactionState) {
+	if transaction != nil {
+		job.Transactions = append(job.Transactions, transaction)
+	}
+}
+
+// Function to merge a change into a waiting job, a rebuild absorbs any column update
+func (job *syncJob) addFields(fields map[string]interface{}) {
+	if fields == nil || job.Fields == nil {
+		job.Fields = nil
+		return
+	}
+	for name, value := range fields {
+		job.Fields[name] = value
+	}
+}
+
+// Function to hand a rebuild to the worker of its project, blocks while the queue is full
+func (h *syncHandler) dispatch(job *syncJob) {
+	worker := job.ProjectID % len(h.queues)
+	if worker < 0 {
+		worker += len(h.queues)
+	}
+	h.queues[worker] <- job
+}
+
+// Function to run the rebuilds of a worker. Rebuilds already waiting in the queue are taken
+// along, up to a batch, so a statement touching many projects is rebuilt in few queries
+func (h *syncHandler) runWorker(queue chan *syncJob) {
+	for job := range queue {
+		batch := []*syncJob{job}
+	collect:
+		for len(batch) < syncBatchSize {
+			select {
+			case next := <-queue:
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		failed, err := h.runJobs(batch)
+
+		h.Lock()
+		for _, job := range batch {
+			jobErr := err
+			if jobErr == nil {
+				jobErr = failed[job.ProjectID]
+			}
+			if errors.Is(jobErr, errESUnavailable) {
+				h.flushErr = jobErr
+			} else if jobErr != nil {
+				h.failed[job.ProjectID] = jobErr
+			}
+			for _, transaction := range job.Transactions {
+				transaction.remaining--
+				if transaction.remaining == 0 {
+					pendingTransactions.release(transaction.projectIDs)
+				}
+			}
+			h.inFlight--
+		}
+		if h.inFlight == 0 {
+			h.idle.Broadcast()
+		}
+		h.Unlock()
+
+		for range batch {
+			<-h.slots
+		}
+	}
+}
+
+// Function to rebuild the projects of a batch of jobs, a panic fails the batch instead of the service
+func (h *syncHandler) runJobs(batch []*syncJob) (failed map[int]error, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	// The same project can be queued twice, its changes are merged in queue order
+	changes := newProjectChanges()
+	for _, job := range batch {
+		changes.add(job.ProjectID, job.Fields)
+	}
+	return syncProjectsToSinks(h.pgDB, changes)
+}
+
+// Function to drop the collected events of a transaction, it is delivered again as a whole
+func (h *syncHandler) Discard(txID int64) {
+	h.Lock()
+	defer h.Unlock()
+	if h.openTransaction != nil && h.openTransaction.TxID == txID {
+		h.openTransaction = nil
+	}
+}
+
+func (h *syncHandler) Flush() error {
+	// Sources only flush between transactions, the open one is complete
+	h.Lock()
+	complete := h.openTransaction
+	h.openTransaction = nil
+	h.Unlock()
+	if complete != nil {
+		h.applyTransaction(complete)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	_, err := h.flush()
+	return err
+}
+
+// Function to wait for the scheduled rebuilds, flush the sinks and store the pending events
+// whose documents failed as dead letters. Returns the failed projects. Must be called
+// with the handler locked
+func (h *syncHandler) flush() (map[int]error, error) {
+	for h.inFlight > 0 {
+		h.idle.Wait()
+	}
+
+	pending := h.pending
+	failed := h.failed
+	flushErr := h.flushErr
+	h.pending = nil
+	h.failed = map[int]error{}
+	h.flushErr = nil
+	if flushErr != nil {
+		return nil, flushErr
+	}
+
+	sinkFailed, err := flushSinks(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for projectID, syncErr := range sinkFailed {
+		if _, ok := failed[projectID]; !ok {
+			failed[projectID] = syncErr
+		}
+	}
+
+	for _, pendingEvent := range pending {
+		for _, projectID := range pendingEvent.ProjectIDs {
+			syncErr, ok := failed[projectID]
+			if !ok {
+				continue
+			}
+
+			event := pendingEvent.Event
+			log.Printf("Error syncing %s on %s, storing dead letter: %v", event.Operation, event.Table, syncErr)
+			err := insertDeadLetter(h.pgDB, event, syncErr)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return failed, nil
+}
+
+// Function to report how many project rebuilds are waiting for the workers
+func (h *syncHandler) queueStatus() syncQueueStatus {
+	status := syncQueueStatus{Workers: len(h.queues)}
+	for _, queue := range h.queues {
+		status.QueueDepth += len(queue)
+		status.QueueCapacity += cap(queue)
+	}
+
+	h.Lock()
+	status.Debouncing = len(h.scheduled)
+	status.InFlight = h.inFlight
+	h.Unlock()
+	return status
+}
+
+// Function to sync a dead letter again. It is removed if the sync succeeds,
+// otherwise the attempt and its error are recorded and the sync error returned
+func (h *syncHandler) retryDeadLetter(id int64) error {
+	letter, err := getDeadLetter(h.pgDB, id)
+	if err != nil {
+		return err
+	}
+
+	syncErrs, err := h.retryDeadLetters([]deadLetter{letter})
+	if err != nil {
+		return err
+	}
+	return syncErrs[id]
+}
+
+// Function to sync several dead letters again with a single flush. Letters that synced are
+// removed, for the others the attempt is recorded. Returns the error of every letter that
+// still fails, or sql.ErrNoRows for letters removed by someone else in the meantime
+func (h *syncHandler) retryDeadLetters(letters []deadLetter) (map[int64]error, error) {
+	syncErrs := map[int64]error{}
+
+	// Documents are rebuilt from the current postgres state, a late retry can't undo newer changes.
+	// The projects are always rebuilt, the column values of the events may be outdated by now
+	changes := newProjectChanges()
+	letterProjects := map[int64][]int{}
+	for _, letter := range letters {
+		event, err := decodeChangeEvent(letter.Payload)
+		if err != nil {
+			syncErrs[letter.ID] = err
+			continue
+		}
+		projectIDs, err := changeEventProjects(h.pgDB, event)
+		if err != nil {
+			syncErrs[letter.ID] = err
+			continue
+		}
+		letterProjects[letter.ID] = projectIDs
+		for _, projectID := range projectIDs {
+			changes.add(projectID, nil)
+		}
+	}
+
+	if len(letterProjects) > 0 {
+		failed, err := h.syncChanges(changes)
+		for id, projectIDs := range letterProjects {
+			if err != nil {
+				syncErrs[id] = err
+				continue
+			}
+			for _, projectID := range projectIDs {
+				if failedErr, ok := failed[projectID]; ok {
+					syncErrs[id] = failedErr
+					break
+				}
+			}
+		}
+	}
+
+	for _, letter := range letters {
+		if syncErr, ok := syncErrs[letter.ID]; ok {
+			err := updateDeadLetterAttempt(h.pgDB, letter.ID, syncErr)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err := discardDeadLetter(h.pgDB, letter.ID)
+		if err == sql.ErrNoRows {
+			syncErrs[letter.ID] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return syncErrs, nil
+}
+
+// Function to apply changes outside of the source and wait for their writes. Returns the failed projects
+func (h *syncHandler) syncChanges(changes *projectChanges) (map[int]error, error) {
+	// Going through the workers keeps the rebuilds ordered with the changes of the source
+	h.enqueue(changes, nil, nil)
+
+	h.Lock()
+	defer h.Unlock()
+
+	// The flush also covers events the source handled in the meantime
+	sourcePending := len(h.pending) > 0
+	failed, err := h.flush()
+	if err != nil && sourcePending {
+		// Make sure the source hears that its pending events weren't written
+		h.flushErr = err
+	}
+	return failed, err
+}
+
+// Most dead letters retried with a single flush
+const deadLetterRetryBatchSize = 500
+
+// Function to retry every dead letter, returns how many were synced and how many still fail
+func (h *syncHandler) retryAllDeadLetters() (int, int, error) {
+	ids, err := listDeadLetterIDs(h.pgDB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	synced, failed := 0, 0
+	for start := 0; start < len(ids); start += deadLetterRetryBatchSize {
+		end := start + deadLetterRetryBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		// Letters discarded or retried by someone else in the meantime are left out
+		letters, err := getDeadLetters(h.pgDB, ids[start:end])
+		if err != nil {
+			return synced, failed, err
+		}
+		if len(letters) == 0 {
+			continue
+		}
+
+		syncErrs, err := h.retryDeadLetters(letters)
+		if err != nil {
+			return synced, failed, err
+		}
+		for _, letter := range letters {
+			syncErr, ok := syncErrs[letter.ID]
+			if !ok {
+				synced++
+			} else if syncErr != sql.ErrNoRows {
+				failed++
+			}
+		}
+	}
+	return synced, failed, nil
+}
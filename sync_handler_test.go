@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjectChanges(t *testing.T) {
+	type change struct {
+		projectID int
+		fields    map[string]interface{}
+	}
+
+	tests := []struct {
+		name       string
+		changes    []change
+		projectIDs []int
+		updates    map[int]map[string]interface{}
+	}{
+		{
+			name: "updates merge",
+			changes: []change{
+				{projectID: 1, fields: map[string]interface{}{"name": "fold", "budget": 10}},
+				{projectID: 1, fields: map[string]interface{}{"name": "fold finance"}},
+			},
+			projectIDs: []int{1},
+			updates:    map[int]map[string]interface{}{1: {"name": "fold finance", "budget": 10}},
+		},
+		{
+			name: "rebuild after update",
+			changes: []change{
+				{projectID: 1, fields: map[string]interface{}{"name": "fold"}},
+				{projectID: 1},
+			},
+			projectIDs: []int{1},
+			updates:    map[int]map[string]interface{}{},
+		},
+		{
+			name: "update after rebuild",
+			changes: []change{
+				{projectID: 1},
+				{projectID: 1, fields: map[string]interface{}{"name": "fold"}},
+			},
+			projectIDs: []int{1},
+			updates:    map[int]map[string]interface{}{},
+		},
+		{
+			name: "projects in order of their first change",
+			changes: []change{
+				{projectID: 2},
+				{projectID: 1, fields: map[string]interface{}{"name": "fold"}},
+				{projectID: 2, fields: map[string]interface{}{"name": "ledger"}},
+			},
+			projectIDs: []int{2, 1},
+			updates:    map[int]map[string]interface{}{1: {"name": "fold"}},
+		},
+	}
+
+	for _, test := range tests {
+		changes := newProjectChanges()
+		for _, change := range test.changes {
+			changes.add(change.projectID, change.fields)
+		}
+		if !reflect.DeepEqual(changes.ProjectIDs, test.projectIDs) {
+			t.Errorf("%s: got projects %v, want %v", test.name, changes.ProjectIDs, test.projectIDs)
+		}
+		if !reflect.DeepEqual(changes.Updates, test.updates) {
+			t.Errorf("%s: got updates %v, want %v", test.name, changes.Updates, test.updates)
+		}
+	}
+}
+
+func TestSyncJobAddFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		add    map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name:   "updates merge",
+			fields: map[string]interface{}{"name": "fold", "budget": 10},
+			add:    map[string]interface{}{"name": "fold finance"},
+			want:   map[string]interface{}{"name": "fold finance", "budget": 10},
+		},
+		{
+			name:   "rebuild after update",
+			fields: map[string]interface{}{"name": "fold"},
+		},
+		{
+			name: "update after rebuild",
+			add:  map[string]interface{}{"name": "fold"},
+		},
+	}
+
+	for _, test := range tests {
+		job := &syncJob{ProjectID: 1, Fields: test.fields}
+		job.addFields(test.add)
+		if !reflect.DeepEqual(job.Fields, test.want) {
+			t.Errorf("%s: got fields %v, want %v", test.name, job.Fields, test.want)
+		}
+	}
+}